@@ -3,13 +3,15 @@ module waf-go-envoy
 go 1.19
 
 require (
+	github.com/andybalholm/brotli v1.0.6
 	github.com/cncf/xds/go v0.0.0-20230428030218-4003588d1b74
 	github.com/corazawaf/coraza/v3 v3.0.0-rc.2
 	github.com/envoyproxy/envoy v1.27.0
-	github.com/json-iterator/go v1.1.12
 	github.com/magefile/mage v1.14.0
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/shirou/gopsutil v3.21.11+incompatible
 	google.golang.org/protobuf v1.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -17,8 +19,6 @@ require (
 	github.com/envoyproxy/protoc-gen-validate v0.1.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
-	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
-	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/petar-dambovaliev/aho-corasick v0.0.0-20211021192214-5ab2d9280aa9 // indirect
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
@@ -24,6 +24,11 @@ func Build() error {
 	return sh.RunV("go", "build", "-o", "plugin.so", "-buildmode=c-shared", "./plugin")
 }
 
+// LintConfig validates the waf-go-envoy plugin_config of an Envoy configuration file, compiling every directive set.
+func LintConfig(path string) error {
+	return sh.RunV("go", "run", "-tags", "lintconfig", "./plugin", path)
+}
+
 // RunExample spins up the test environment, access at http://localhost:8080. Requires docker-compose.
 func RunExample() error {
 	return sh.RunV("docker-compose", "--file", "example/docker-compose.yml", "up", "-d")
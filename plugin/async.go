@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"time"
+)
+
+// inspectionPool bounds the inspections running at once when async_inspection is enabled,
+// the streams over the bound wait for a slot without holding the Envoy worker
+type inspectionPool chan struct{}
+
+func newInspectionPool(workers int) inspectionPool {
+	return make(inspectionPool, workers)
+}
+
+func (p inspectionPool) acquire() {
+	p <- struct{}{}
+}
+
+func (p inspectionPool) release() {
+	<-p
+}
+
+// inspect runs the inspection of a filter callback. With async_inspection it runs on a goroutine, the callback
+// returns api.Running and the goroutine resumes the stream, either through the local reply sent by the inspection
+// or through Continue. The inspections of a stream never overlap, a response may arrive while the request body is
+// still being inspected.
+func (f *filter) inspect(inspection func() api.StatusType) api.StatusType {
+	if f.conf.inspectionPool == nil || f.conf.ruleEngine == types.RuleEngineOff {
+		return f.runInspection(inspection)
+	}
+	f.inspecting.Add(1)
+	go func() {
+		defer f.callbacks.RecoverPanic()
+		defer f.inspecting.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// the stream may be destroyed while the inspection waits for the previous one or for a slot
+		if f.destroyed.Load() {
+			return
+		}
+		f.conf.inspectionPool.acquire()
+		defer f.conf.inspectionPool.release()
+		if f.destroyed.Load() {
+			return
+		}
+		status := f.runInspection(inspection)
+		if status != api.LocalReply && !f.destroyed.Load() {
+			f.callbacks.Continue(status)
+		}
+	}()
+	return api.Running
+}
+
+// runInspection charges the time spent inspecting to the inspection_budget of the transaction, once the budget
+// is spent the on_error policy applies: closed rejects the stream, open lets it continue without inspecting the
+// following phases. An inspection already running is never cut short.
+func (f *filter) runInspection(inspection func() api.StatusType) (status api.StatusType) {
+	if f.budgetExceeded || f.panicked {
+		return api.Continue
+	}
+	defer f.recoverInspection(&status)
+	start := time.Now()
+	status = inspection()
+	f.inspectionTime += time.Since(start)
+	if f.conf.inspectionBudget > 0 && f.inspectionTime > f.conf.inspectionBudget && f.tx != nil && !f.isInterruption {
+		f.budgetExceeded = true
+		metrics.budgetExceeded.inc(f.directive, f.host)
+		f.logStream(api.Warn, f.log().duration("spent", f.inspectionTime).duration("budget", f.conf.inspectionBudget).msg("Inspection budget exceeded, the following phases are not inspected"))
+		if rejected, ok := f.onError("Budget"); ok {
+			return rejected
+		}
+	}
+	return status
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClosedTransaction reports when the transaction is closed
+type testClosedTransaction struct {
+	types.Transaction
+	closed chan struct{}
+}
+
+func (tx testClosedTransaction) Close() error {
+	defer close(tx.closed)
+	return tx.Transaction.Close()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInspectSync(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       inspectionPool
+		ruleEngine types.RuleEngineStatus
+	}{
+		{"no pool", nil, types.RuleEngineOn},
+		// the stream is not inspected with the rule engine off, the callback returns right away
+		{"rule engine off", newInspectionPool(1), types.RuleEngineOff},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{callbacks: callbacks, conf: configuration{inspectionPool: test.pool, ruleEngine: test.ruleEngine}}
+		if got := f.inspect(func() api.StatusType { return api.StopAndBuffer }); got != api.StopAndBuffer {
+			t.Errorf("%s: inspect = %v, want %v", test.name, got, api.StopAndBuffer)
+		}
+		if len(callbacks.statuses) != 0 {
+			t.Errorf("%s: stream continued with %v", test.name, callbacks.statuses)
+		}
+	}
+}
+
+func TestInspectAsync(t *testing.T) {
+	tests := []struct {
+		name   string
+		status api.StatusType
+		want   []api.StatusType
+	}{
+		{"continue", api.Continue, []api.StatusType{api.Continue}},
+		{"stop", api.StopAndBuffer, []api.StatusType{api.StopAndBuffer}},
+		// the local reply resumes the stream
+		{"local reply", api.LocalReply, nil},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{callbacks: callbacks, conf: configuration{inspectionPool: newInspectionPool(1)}}
+		status := test.status
+		if got := f.inspect(func() api.StatusType { return status }); got != api.Running {
+			t.Errorf("%s: inspect = %v, want %v", test.name, got, api.Running)
+		}
+		f.inspecting.Wait()
+		if !reflect.DeepEqual(callbacks.statuses, test.want) {
+			t.Errorf("%s: stream continued with %v, want %v", test.name, callbacks.statuses, test.want)
+		}
+	}
+}
+
+func TestInspectionPool(t *testing.T) {
+	const workers, streams = 2, 5
+	pool := newInspectionPool(workers)
+	release := make(chan struct{})
+	var running, peak atomic.Int32
+	inspection := func() api.StatusType {
+		n := running.Add(1)
+		for {
+			old := peak.Load()
+			if n <= old || peak.CompareAndSwap(old, n) {
+				break
+			}
+		}
+		<-release
+		running.Add(-1)
+		return api.Continue
+	}
+	filters := make([]*filter, streams)
+	for i := range filters {
+		filters[i] = &filter{callbacks: newTestCallbacks(), conf: configuration{inspectionPool: pool}}
+		filters[i].inspect(inspection)
+	}
+	waitFor(t, "the pool to be full", func() bool { return running.Load() == workers })
+	// the inspections over the bound wait for a slot
+	time.Sleep(20 * time.Millisecond)
+	if got := running.Load(); got != workers {
+		t.Errorf("%d inspections running, want %d", got, workers)
+	}
+	close(release)
+	for _, f := range filters {
+		f.inspecting.Wait()
+		if got := f.callbacks.(*testCallbacks).statuses; !reflect.DeepEqual(got, []api.StatusType{api.Continue}) {
+			t.Errorf("stream continued with %v", got)
+		}
+	}
+	if got := peak.Load(); got != workers {
+		t.Errorf("%d inspections ran at once, want %d", got, workers)
+	}
+}
+
+func TestInspectSerializesStream(t *testing.T) {
+	f := &filter{callbacks: newTestCallbacks(), conf: configuration{inspectionPool: newInspectionPool(2)}}
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, event)
+	}
+	var started atomic.Bool
+	f.inspect(func() api.StatusType {
+		started.Store(true)
+		record("request start")
+		<-release
+		record("request end")
+		return api.Continue
+	})
+	waitFor(t, "the request inspection", started.Load)
+	// the response inspection waits for the request one, although the pool has a free slot
+	f.inspect(func() api.StatusType {
+		record("response")
+		return api.Continue
+	})
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	f.inspecting.Wait()
+	if want := []string{"request start", "request end", "response"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("inspections ran in order %v, want %v", order, want)
+	}
+}
+
+func TestOnDestroyWaitsForInspections(t *testing.T) {
+	callbacks := newTestCallbacks()
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives("SecRuleEngine On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the filter closes the transaction
+	tx := testClosedTransaction{Transaction: waf.NewTransaction(), closed: make(chan struct{})}
+	f := &filter{callbacks: callbacks, conf: configuration{inspectionPool: newInspectionPool(1)}, tx: tx, processResponseBody: true}
+	release := make(chan struct{})
+	var started, queuedRan atomic.Bool
+	f.inspect(func() api.StatusType {
+		started.Store(true)
+		<-release
+		return api.Continue
+	})
+	waitFor(t, "the inspection", started.Load)
+	// queued waits for the running inspection of the stream
+	f.inspect(func() api.StatusType {
+		queuedRan.Store(true)
+		return api.Continue
+	})
+	f.OnDestroy(api.Normal)
+	select {
+	case <-tx.closed:
+		t.Fatal("transaction closed while an inspection is running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-tx.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("transaction not closed once the inspections are done")
+	}
+	// the inspection queued when the stream was destroyed is skipped, the stream is no longer resumed
+	if queuedRan.Load() {
+		t.Error("queued inspection ran after OnDestroy")
+	}
+	callbacks.mu.Lock()
+	defer callbacks.mu.Unlock()
+	if len(callbacks.statuses) != 0 {
+		t.Errorf("destroyed stream continued with %v", callbacks.statuses)
+	}
+}
+
+func TestRunInspectionBudget(t *testing.T) {
+	tests := []struct {
+		name        string
+		budget      time.Duration
+		spent       time.Duration
+		closed      bool
+		noTx        bool
+		interrupted bool
+		status      api.StatusType
+		want        api.StatusType
+		exceeded    bool
+		replies     []int
+	}{
+		{"no budget", 0, time.Hour, true, false, false, api.Continue, api.Continue, false, nil},
+		{"within budget", time.Hour, 0, true, false, false, api.Continue, api.Continue, false, nil},
+		// the open policy lets the stream continue without inspecting the following phases
+		{"open", time.Nanosecond, time.Nanosecond, false, false, false, api.StopAndBuffer, api.StopAndBuffer, true, nil},
+		{"closed", time.Nanosecond, time.Nanosecond, true, false, false, api.Continue, api.LocalReply, true, []int{defaultOnErrorStatus}},
+		// the budget is charged to the transaction, it is not created yet
+		{"no transaction", time.Nanosecond, time.Nanosecond, true, true, false, api.Continue, api.Continue, false, nil},
+		{"interrupted", time.Nanosecond, time.Nanosecond, true, false, true, api.LocalReply, api.LocalReply, false, nil},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{
+			callbacks:      callbacks,
+			conf:           configuration{inspectionBudget: test.budget, onErrorPolicies: map[string]*onErrorPolicy{"waf1": {closed: test.closed, status: defaultOnErrorStatus}}},
+			directive:      "waf1",
+			inspectionTime: test.spent,
+		}
+		if !test.noTx {
+			f.tx = newTestTransaction(t, "SecRuleEngine On")
+		}
+		status := test.status
+		got := f.runInspection(func() api.StatusType {
+			time.Sleep(time.Millisecond)
+			f.isInterruption = test.interrupted
+			return status
+		})
+		if got != test.want || f.budgetExceeded != test.exceeded || !reflect.DeepEqual(callbacks.replies, test.replies) {
+			t.Errorf("%s: runInspection = %v, exceeded %v, replies %v, want %v, %v, %v", test.name, got, f.budgetExceeded, callbacks.replies, test.want, test.exceeded, test.replies)
+		}
+		if _, ok := callbacks.metadata["error"]; ok != test.exceeded {
+			t.Errorf("%s: error metadata %v", test.name, callbacks.metadata["error"])
+		}
+		if !test.exceeded {
+			continue
+		}
+		// the following phases are not inspected
+		if got := f.runInspection(func() api.StatusType {
+			t.Errorf("%s: inspection ran once the budget is spent", test.name)
+			return api.StopAndBuffer
+		}); got != api.Continue {
+			t.Errorf("%s: runInspection = %v once the budget is spent, want %v", test.name, got, api.Continue)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/auditlog"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// auditLogWriterName is the SecAuditLogType of the sinks, SecAuditLog carries the key of the sink
+	auditLogWriterName = "waf-go-envoy"
+
+	auditLogSinkFile   = "file"
+	auditLogSinkSyslog = "syslog"
+	auditLogSinkStdout = "stdout"
+
+	defaultAuditLogFormat     = "json"
+	defaultAuditLogBufferSize = 1024
+)
+
+func init() {
+	auditlog.RegisterWriter(auditLogWriterName, func() auditlog.Writer {
+		return &auditWriter{}
+	})
+}
+
+// AuditLog configures the audit log sink of a directive set, SecAuditEngine and SecAuditLogParts
+// of the directive set still select the transactions and parts written to it
+type AuditLog struct {
+	// Sink is file, syslog or stdout
+	Sink string `json:"sink"`
+	// Format is the SecAuditLogFormat of the entries, json by default
+	Format string `json:"format"`
+	// BufferSize is the number of entries waiting for the sink, the entries over it are dropped
+	BufferSize int `json:"buffer_size"`
+
+	// Path, MaxSizeMB, RotateInterval, MaxBackups and MaxAge configure the file sink
+	Path           string `json:"path"`
+	MaxSizeMB      int    `json:"max_size_mb"`
+	RotateInterval string `json:"rotate_interval"`
+	MaxBackups     int    `json:"max_backups"`
+	MaxAge         string `json:"max_age"`
+
+	// Network, Address, Facility and Tag configure the syslog sink
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Facility string `json:"facility"`
+	Tag      string `json:"tag"`
+}
+
+// auditLogDirectives returns the directives routing the audit logs of the directive set to its sink
+func auditLogDirectives(config *AuditLog) ([]string, error) {
+	name, err := auditSinkName(config)
+	if err != nil {
+		return nil, err
+	}
+	format := config.Format
+	if len(format) == 0 {
+		format = defaultAuditLogFormat
+	}
+	return []string{
+		"SecAuditLogType " + auditLogWriterName,
+		"SecAuditLog " + auditSinkKey(name),
+		"SecAuditLogFormat " + format,
+	}, nil
+}
+
+// auditOutput writes the formatted entries of a sink
+type auditOutput interface {
+	write(entry []byte) error
+	flush() error
+	close() error
+}
+
+type auditEntry struct {
+	log       *auditlog.Log
+	formatter auditlog.Formatter
+}
+
+// auditSink formats and writes the entries on its own goroutine, so that a slow sink never blocks the Envoy workers
+type auditSink struct {
+	name    string
+	output  auditOutput
+	entries chan auditEntry
+	// mu guards closed, the entries are no longer sent once the sink is closed
+	mu     sync.RWMutex
+	closed bool
+	// done is closed once the entries are written and the output is closed
+	done chan struct{}
+}
+
+// auditSinkSlot holds the sink of a file, syslog address or stdout. The sink is replaced when a configuration
+// changes its settings, so that a file has a single writer, and closed once no configuration uses it.
+type auditSinkSlot struct {
+	name     string
+	settings string
+	sink     atomic.Pointer[auditSink]
+	// refs counts the handles of the configurations using the sink, guarded by auditSinks
+	refs int
+}
+
+// auditSinks holds the sink slots by key, the directive sets writing to the same destination share the sink.
+// pending counts the configurations being parsed which use the key.
+var auditSinks = struct {
+	sync.Mutex
+	slots   map[string]*auditSinkSlot
+	pending map[string]int
+}{slots: make(map[string]*auditSinkSlot), pending: make(map[string]int)}
+
+// auditSinkHandle is referenced by the configuration, the sink is closed once the configurations
+// using it, and therefore their handles, are garbage collected
+type auditSinkHandle struct {
+	slot *auditSinkSlot
+}
+
+// auditSinkName returns the destination of the sink, which identifies it
+func auditSinkName(config *AuditLog) (string, error) {
+	switch config.Sink {
+	case auditLogSinkFile:
+		if len(config.Path) == 0 {
+			return "", errors.New("audit_log path is empty")
+		}
+		return auditLogSinkFile + ":" + filepath.Clean(config.Path), nil
+	case auditLogSinkSyslog:
+		return auditLogSinkSyslog + ":" + config.Network + ":" + config.Address, nil
+	case auditLogSinkStdout:
+		return auditLogSinkStdout, nil
+	}
+	return "", errors.New(fmt.Sprintf("audit_log sink %s is not supported, use %s, %s or %s", config.Sink, auditLogSinkFile, auditLogSinkSyslog, auditLogSinkStdout))
+}
+
+// auditSinkKey is the SecAuditLog value of the sink
+func auditSinkKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// auditSinkSettings returns the settings of the sink, the format belongs to the directive set
+func auditSinkSettings(config *AuditLog) (string, error) {
+	settings := *config
+	settings.Format = ""
+	b, err := json.Marshal(&settings)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// auditSinkRegistration is the validated sink of a directive set, it is registered once the configuration is accepted
+type auditSinkRegistration struct {
+	key      string
+	settings string
+	sink     *auditSink
+}
+
+// prepareAuditSink validates the config and creates its sink, without starting it nor touching the registered sinks
+func prepareAuditSink(config *AuditLog) (*auditSinkRegistration, error) {
+	if len(config.Format) != 0 {
+		if _, err := auditlog.GetFormatter(config.Format); err != nil {
+			return nil, errors.New(fmt.Sprintf("audit_log format %s is not supported", config.Format))
+		}
+	}
+	name, err := auditSinkName(config)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := auditSinkSettings(config)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := newAuditSink(name, config)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSinkRegistration{key: auditSinkKey(name), settings: settings, sink: sink}, nil
+}
+
+// register returns the handle of the sink. A sink registered with other settings is replaced,
+// its entries are written before its output is closed.
+func (r *auditSinkRegistration) register() *auditSinkHandle {
+	auditSinks.Lock()
+	defer auditSinks.Unlock()
+	slot, ok := auditSinks.slots[r.key]
+	if !ok || slot.settings != r.settings {
+		if !ok {
+			slot = &auditSinkSlot{name: r.sink.name}
+			auditSinks.slots[r.key] = slot
+		}
+		slot.settings = r.settings
+		replaced := slot.sink.Swap(r.sink)
+		if replaced != nil {
+			replaced.close()
+		}
+		if !lintOnly {
+			go r.sink.run(replaced)
+		}
+	}
+	slot.refs++
+	handle := &auditSinkHandle{slot: slot}
+	key := r.key
+	runtime.SetFinalizer(handle, func(h *auditSinkHandle) {
+		h.slot.release(key)
+	})
+	return handle
+}
+
+// pendAuditSinks lets the WAFs of a configuration being parsed refer to its sinks before they are registered,
+// the function returned ends it
+func pendAuditSinks(registrations map[string]*auditSinkRegistration) func() {
+	auditSinks.Lock()
+	defer auditSinks.Unlock()
+	for _, r := range registrations {
+		auditSinks.pending[r.key]++
+	}
+	return func() {
+		auditSinks.Lock()
+		defer auditSinks.Unlock()
+		for _, r := range registrations {
+			if auditSinks.pending[r.key]--; auditSinks.pending[r.key] == 0 {
+				delete(auditSinks.pending, r.key)
+			}
+		}
+	}
+}
+
+// release closes the sink once no configuration uses it
+func (s *auditSinkSlot) release(key string) {
+	auditSinks.Lock()
+	defer auditSinks.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(auditSinks.slots, key)
+	s.sink.Load().close()
+}
+
+func lookupAuditSink(key string) (*auditSinkSlot, bool) {
+	auditSinks.Lock()
+	defer auditSinks.Unlock()
+	slot, ok := auditSinks.slots[key]
+	return slot, ok
+}
+
+// knownAuditSink reports whether the key is the one of a sink registered or pending
+func knownAuditSink(key string) bool {
+	auditSinks.Lock()
+	defer auditSinks.Unlock()
+	_, registered := auditSinks.slots[key]
+	return registered || auditSinks.pending[key] > 0
+}
+
+func newAuditSink(name string, config *AuditLog) (*auditSink, error) {
+	if config.BufferSize < 0 {
+		return nil, errors.New("audit_log buffer_size must not be negative")
+	}
+	bufferSize := config.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultAuditLogBufferSize
+	}
+	var output auditOutput
+	var err error
+	switch config.Sink {
+	case auditLogSinkFile:
+		output, err = newRotatingFile(config)
+	case auditLogSinkSyslog:
+		output, err = newSyslogOutput(config)
+	default:
+		output = stdoutOutput{}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &auditSink{name: name, output: output, entries: make(chan auditEntry, bufferSize), done: make(chan struct{})}, nil
+}
+
+// run writes the entries once the sink it replaces, if any, is done
+func (s *auditSink) run(replaced *auditSink) {
+	defer close(s.done)
+	if replaced != nil {
+		<-replaced.done
+	}
+	failing := false
+	for entry := range s.entries {
+		b, err := entry.formatter(entry.log)
+		if err == nil {
+			err = s.output.write(b)
+		}
+		if err == nil && len(s.entries) == 0 {
+			err = s.output.flush()
+		}
+		if err != nil {
+			metrics.auditLogErrors.inc(s.name)
+			if !failing {
+				api.LogError(BuildLoggerMessage().str("sink", s.name).err(err).msg("Failed to write audit log"))
+			}
+		} else if failing {
+			api.LogInfo(BuildLoggerMessage().str("sink", s.name).msg("Audit log recovered"))
+		}
+		failing = err != nil
+	}
+	if err := s.output.close(); err != nil {
+		api.LogError(BuildLoggerMessage().str("sink", s.name).err(err).msg("Failed to close audit log"))
+	}
+}
+
+// send queues the entry, the entries over the buffer or sent to a closed sink are dropped
+func (s *auditSink) send(entry auditEntry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		metrics.auditLogsDropped.inc(s.name)
+		return
+	}
+	select {
+	case s.entries <- entry:
+	default:
+		metrics.auditLogsDropped.inc(s.name)
+	}
+}
+
+// close stops the sink once its queued entries are written
+func (s *auditSink) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.entries)
+}
+
+// auditWriter is the Coraza audit log writer of a WAF, it hands the entries over to the current sink of its slot.
+// The slot is resolved on the first entry, the WAFs are created before their sinks are registered.
+type auditWriter struct {
+	key       string
+	slot      atomic.Pointer[auditSinkSlot]
+	formatter auditlog.Formatter
+}
+
+func (w *auditWriter) Init(config auditlog.Config) error {
+	if !knownAuditSink(config.File) {
+		return errors.New(fmt.Sprintf("audit log sink %s does not exist, configure audit_log instead of SecAuditLogType %s", config.File, auditLogWriterName))
+	}
+	w.key = config.File
+	w.formatter = config.Formatter
+	return nil
+}
+
+func (w *auditWriter) Write(log *auditlog.Log) error {
+	slot := w.slot.Load()
+	if slot == nil {
+		var ok bool
+		if slot, ok = lookupAuditSink(w.key); !ok {
+			// the WAFs of a rejected configuration have no sink
+			return nil
+		}
+		w.slot.Store(slot)
+	}
+	slot.sink.Load().send(auditEntry{log: log, formatter: w.formatter})
+	return nil
+}
+
+func (w *auditWriter) Close() error {
+	return nil
+}
+
+// stdoutOutput writes every entry with a single write, so that the entries of several sinks do not interleave
+type stdoutOutput struct{}
+
+func (o stdoutOutput) write(entry []byte) error {
+	_, err := os.Stdout.Write(append(trimEntry(entry), '\n'))
+	return err
+}
+
+func (o stdoutOutput) flush() error {
+	return nil
+}
+
+func (o stdoutOutput) close() error {
+	return nil
+}
+
+// parseAuditLogDuration parses an optional duration of the audit_log config
+func parseAuditLogDuration(key, value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.New(fmt.Sprintf("audit_log %s %s is not a positive duration", key, value))
+	}
+	return d, nil
+}
+
+// trimEntry drops the trailing newline of the formatted entry, the outputs frame the entries themselves
+func trimEntry(entry []byte) []byte {
+	return bytes.TrimRight(entry, "\n")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const auditLogBackupTimeFormat = "20060102T150405.000000000"
+
+// rotatingFile writes the entries as lines of a file, which is rotated once it reaches max_size_mb or
+// once rotate_interval elapsed. The rotated files are renamed path.<UTC time>, the ones over max_backups
+// or older than max_age are removed.
+type rotatingFile struct {
+	path           string
+	maxSize        int64
+	rotateInterval time.Duration
+	maxBackups     int
+	maxAge         time.Duration
+	file           *os.File
+	w              *bufio.Writer
+	size           int64
+	openedAt       time.Time
+}
+
+func newRotatingFile(config *AuditLog) (*rotatingFile, error) {
+	if config.MaxSizeMB < 0 || config.MaxBackups < 0 {
+		return nil, errors.New("audit_log max_size_mb and max_backups must not be negative")
+	}
+	rotateInterval, err := parseAuditLogDuration("rotate_interval", config.RotateInterval)
+	if err != nil {
+		return nil, err
+	}
+	maxAge, err := parseAuditLogDuration("max_age", config.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{
+		path:           config.Path,
+		maxSize:        int64(config.MaxSizeMB) * 1024 * 1024,
+		rotateInterval: rotateInterval,
+		maxBackups:     config.MaxBackups,
+		maxAge:         maxAge,
+	}, nil
+}
+
+func (r *rotatingFile) write(entry []byte) error {
+	entry = trimEntry(entry)
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(entry))+1 > r.maxSize) ||
+		(r.rotateInterval > 0 && time.Since(r.openedAt) >= r.rotateInterval)) {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.w.Write(entry)
+	r.size += int64(n)
+	if err != nil {
+		return err
+	}
+	r.size++
+	return r.w.WriteByte('\n')
+}
+
+func (r *rotatingFile) flush() error {
+	if r.w == nil {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+func (r *rotatingFile) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.w = nil, nil
+	return err
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.w = bufio.NewWriter(file)
+	r.size = info.Size()
+	r.openedAt = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file, r.w = nil, nil
+	if err := os.Rename(r.path, r.path+"."+time.Now().UTC().Format(auditLogBackupTimeFormat)); err != nil {
+		return err
+	}
+	r.removeBackups()
+	return r.open()
+}
+
+// removeBackups enforces max_backups and max_age on the rotated files, the oldest are removed first
+func (r *rotatingFile) removeBackups() {
+	if r.maxBackups == 0 && r.maxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(auditLogBackupTimeFormat, strings.TrimPrefix(match, r.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// the time format sorts chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, backup := range backups {
+		expired := false
+		if r.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > r.maxAge {
+				expired = true
+			}
+		}
+		if (r.maxBackups > 0 && i >= r.maxBackups) || expired {
+			_ = os.Remove(backup)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSyslogFacility = "local0"
+	// syslogSeverityInfo is the severity of the audit log messages
+	syslogSeverityInfo = 6
+	syslogDialTimeout  = 5 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogOutput sends the entries as RFC 5424 messages. The stream networks (tcp, unix) frame them
+// with octet counting (RFC 6587), the datagram networks (udp, unixgram) send a message per datagram.
+// The connection is dialed on the first entry and dialed again after a write error.
+type syslogOutput struct {
+	network  string
+	address  string
+	priority int
+	hostname string
+	tag      string
+	pid      string
+	stream   bool
+	conn     net.Conn
+}
+
+func newSyslogOutput(config *AuditLog) (*syslogOutput, error) {
+	var stream bool
+	switch config.Network {
+	case "tcp", "unix":
+		stream = true
+	case "udp", "unixgram":
+	default:
+		return nil, errors.New(fmt.Sprintf("audit_log network %s is not supported, use udp, tcp, unix or unixgram", config.Network))
+	}
+	if len(config.Address) == 0 {
+		return nil, errors.New("audit_log address is empty")
+	}
+	facilityName := config.Facility
+	if len(facilityName) == 0 {
+		facilityName = defaultSyslogFacility
+	}
+	facility, ok := syslogFacilities[facilityName]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("audit_log facility %s is not supported", facilityName))
+	}
+	tag := config.Tag
+	if len(tag) == 0 {
+		tag = pluginName
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	return &syslogOutput{
+		network:  config.Network,
+		address:  config.Address,
+		priority: facility*8 + syslogSeverityInfo,
+		hostname: hostname,
+		tag:      tag,
+		pid:      strconv.Itoa(os.Getpid()),
+		stream:   stream,
+	}, nil
+}
+
+func (s *syslogOutput) write(entry []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, syslogDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s - - %s", s.priority, time.Now().UTC().Format(time.RFC3339Nano), s.hostname, s.tag, s.pid, trimEntry(entry))
+	if s.stream {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *syslogOutput) flush() error {
+	return nil
+}
+
+func (s *syslogOutput) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3/auditlog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitAuditFile waits for the sink goroutine to write the lines of the file
+func waitAuditFile(t *testing.T, path string, lines int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(path)
+		if strings.Count(string(b), "\n") >= lines || time.Now().After(deadline) {
+			return string(b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeAuditEntry(t *testing.T, handle *auditSinkHandle, text string) {
+	w := &auditWriter{formatter: func(*auditlog.Log) ([]byte, error) {
+		return []byte(text), nil
+	}}
+	w.slot.Store(handle.slot)
+	if err := w.Write(&auditlog.Log{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func registerTestAuditSink(t *testing.T, config *AuditLog) *auditSinkHandle {
+	registration, err := prepareAuditSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := registration.register()
+	runtime.SetFinalizer(handle, nil)
+	return handle
+}
+
+func TestAuditSinkLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	first := registerTestAuditSink(t, &AuditLog{Sink: auditLogSinkFile, Path: path})
+	// the same destination with the same settings shares the sink, whatever its format
+	shared := registerTestAuditSink(t, &AuditLog{Sink: auditLogSinkFile, Path: filepath.Dir(path) + "/./audit.log", Format: "jsonlegacy"})
+	if shared.slot != first.slot {
+		t.Fatal("the sink of the path is not shared")
+	}
+	sink := first.slot.sink.Load()
+	writeAuditEntry(t, first, "one")
+
+	// a sink prepared by a configuration is only registered once the configuration is accepted
+	if _, err := prepareAuditSink(&AuditLog{Sink: auditLogSinkFile, Path: path, MaxSizeMB: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if first.slot.sink.Load() != sink || sink.closed {
+		t.Fatal("a prepared sink replaced the registered one")
+	}
+
+	// other settings replace the sink, the writers of the previous configurations follow it
+	replacing := registerTestAuditSink(t, &AuditLog{Sink: auditLogSinkFile, Path: path, MaxSizeMB: 10})
+	if replacing.slot != first.slot || first.slot.sink.Load() == sink {
+		t.Fatal("the sink is not replaced")
+	}
+	if !sink.closed {
+		t.Error("the replaced sink is not closed")
+	}
+	writeAuditEntry(t, first, "two")
+	if got := waitAuditFile(t, path, 2); got != "one\ntwo\n" {
+		t.Errorf("audit log = %q", got)
+	}
+
+	first.slot.release(auditSinkKey(first.slot.name))
+	shared.slot.release(auditSinkKey(shared.slot.name))
+	if _, ok := lookupAuditSink(auditSinkKey(first.slot.name)); !ok {
+		t.Fatal("the sink is released while a configuration uses it")
+	}
+	replacing.slot.release(auditSinkKey(replacing.slot.name))
+	if _, ok := lookupAuditSink(auditSinkKey(first.slot.name)); ok {
+		t.Error("the sink is not released")
+	}
+	if current := first.slot.sink.Load(); !current.closed {
+		t.Error("the released sink is not closed")
+	}
+	// the entries of a closed sink are dropped
+	writeAuditEntry(t, first, "three")
+}
+
+func TestAuditWriterInit(t *testing.T) {
+	registration, err := prepareAuditSink(&AuditLog{Sink: auditLogSinkStdout, BufferSize: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &auditWriter{}
+	config := auditlog.Config{File: registration.key}
+	if err := w.Init(config); err == nil {
+		t.Error("a writer is initialized with an unknown sink")
+	}
+	done := pendAuditSinks(map[string]*auditSinkRegistration{"waf1": registration})
+	if err := w.Init(config); err != nil {
+		t.Errorf("a writer is not initialized with a pending sink: %s", err.Error())
+	}
+	done()
+	if knownAuditSink(registration.key) {
+		t.Error("the sink is still pending")
+	}
+	// the entries of a writer whose sink is never registered are dropped
+	if err := w.Write(&auditlog.Log{}); err != nil || w.slot.Load() != nil {
+		t.Errorf("Write = %v", err)
+	}
+}
+
+func TestAuditSinkName(t *testing.T) {
+	tests := []struct {
+		config AuditLog
+		want   string
+		ok     bool
+	}{
+		{AuditLog{Sink: auditLogSinkFile, Path: "/var/log/../log/waf.log"}, "file:/var/log/waf.log", true},
+		{AuditLog{Sink: auditLogSinkFile}, "", false},
+		{AuditLog{Sink: auditLogSinkSyslog, Network: "udp", Address: "127.0.0.1:514", Tag: "waf"}, "syslog:udp:127.0.0.1:514", true},
+		{AuditLog{Sink: auditLogSinkStdout}, "stdout", true},
+		{AuditLog{Sink: "kafka"}, "", false},
+	}
+	for _, test := range tests {
+		got, err := auditSinkName(&test.config)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("auditSinkName(%+v) = %q, %v, want %q", test.config, got, err, test.want)
+		}
+	}
+}
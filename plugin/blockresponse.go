@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/types"
+	htmltemplate "html/template"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	contentTypeHTML = "text/html; charset=utf-8"
+	contentTypeJSON = "application/json"
+)
+
+// BlockResponse customizes the local reply sent when the directive set interrupts a request
+type BlockResponse struct {
+	// Status overrides the status of deny and drop interruptions, redirects keep theirs
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	// HTML and JSON are templates of the body, the format is picked from the Accept header of the request
+	HTML string `json:"html"`
+	JSON string `json:"json"`
+}
+
+type blockResponse struct {
+	status  int
+	headers map[string]string
+	html    *htmltemplate.Template
+	json    *texttemplate.Template
+}
+
+// blockResponseData is available to the body templates
+type blockResponseData struct {
+	TransactionID string
+	RuleIDs       []int
+	Status        int
+	Timestamp     string
+}
+
+// blockResponseJSONData is the blockResponseData of the json template, its fields are encoded as JSON so that
+// the values are escaped without the json function, e.g. {"id":{{.TransactionID}}}
+type blockResponseJSONData struct {
+	TransactionID jsonValue
+	RuleIDs       jsonValue
+	Status        jsonValue
+	Timestamp     jsonValue
+}
+
+// jsonValue is a value encoded as JSON, the json function leaves it as is
+type jsonValue string
+
+func newBlockResponse(name string, config *BlockResponse) (*blockResponse, error) {
+	if config.Status != 0 && (config.Status < 300 || config.Status > 599) {
+		return nil, errors.New(fmt.Sprintf("%s block_response status %d is not valid, a blocked request cannot succeed", name, config.Status))
+	}
+	r := &blockResponse{status: config.Status, headers: config.Headers}
+	if len(config.HTML) != 0 {
+		html, err := htmltemplate.New(name).Parse(config.HTML)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s block_response html template error:%s", name, err.Error()))
+		}
+		r.html = html
+	}
+	if len(config.JSON) != 0 {
+		jsonTemplate, err := texttemplate.New(name).Funcs(texttemplate.FuncMap{"json": marshalJSON}).Parse(config.JSON)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s block_response json template error:%s", name, err.Error()))
+		}
+		r.json = jsonTemplate
+	}
+	return r, nil
+}
+
+// render returns the body and its content type for the Accept header of the request
+func (r *blockResponse) render(accept string, data blockResponseData) (string, string, error) {
+	var buff bytes.Buffer
+	switch r.format(accept) {
+	case contentTypeJSON:
+		jsonData, err := data.encode()
+		if err != nil {
+			return "", "", err
+		}
+		if err := r.json.Execute(&buff, jsonData); err != nil {
+			return "", "", err
+		}
+		return buff.String(), contentTypeJSON, nil
+	case contentTypeHTML:
+		if err := r.html.Execute(&buff, data); err != nil {
+			return "", "", err
+		}
+		return buff.String(), contentTypeHTML, nil
+	}
+	return "", "", nil
+}
+
+// format negotiates the content type of the body among the configured templates, HTML is preferred on a tie
+func (r *blockResponse) format(accept string) string {
+	if r.html == nil && r.json == nil {
+		return ""
+	}
+	if r.html == nil {
+		return contentTypeJSON
+	}
+	if r.json == nil {
+		return contentTypeHTML
+	}
+	htmlQuality, jsonQuality := 0.0, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil || quality <= 0 {
+				continue
+			}
+		}
+		if mediaType == "text/html" || mediaType == "text/*" || mediaType == "*/*" {
+			htmlQuality = maxQuality(htmlQuality, quality, mediaType == "text/html")
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || mediaType == "application/*" || mediaType == "*/*" {
+			jsonQuality = maxQuality(jsonQuality, quality, mediaType != "application/*" && mediaType != "*/*")
+		}
+	}
+	if jsonQuality > htmlQuality {
+		return contentTypeJSON
+	}
+	return contentTypeHTML
+}
+
+// maxQuality keeps the highest quality, a specific media type slightly outweighs the wildcards of the same quality
+func maxQuality(current, quality float64, specific bool) float64 {
+	if specific {
+		quality += 0.0001
+	}
+	if quality > current {
+		return quality
+	}
+	return current
+}
+
+func newBlockResponseData(id string, ruleIDs []int, status int) blockResponseData {
+	return blockResponseData{
+		TransactionID: id,
+		RuleIDs:       ruleIDs,
+		Status:        status,
+		Timestamp:     time.Now().UTC().Format(time.RFC3339),
+	}
+}
+
+func (d blockResponseData) encode() (blockResponseJSONData, error) {
+	var encoded blockResponseJSONData
+	for field, value := range map[*jsonValue]interface{}{
+		&encoded.TransactionID: d.TransactionID,
+		&encoded.RuleIDs:       d.RuleIDs,
+		&encoded.Status:        d.Status,
+		&encoded.Timestamp:     d.Timestamp,
+	} {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return blockResponseJSONData{}, err
+		}
+		*field = jsonValue(b)
+	}
+	return encoded, nil
+}
+
+// matchedRuleIDs returns the sorted ids of the rules matched by the transaction
+func matchedRuleIDs(tx types.Transaction) []int {
+	matchedRules := tx.MatchedRules()
+	seen := make(map[int]struct{}, len(matchedRules))
+	ids := make([]int, 0, len(matchedRules))
+	for _, matched := range matchedRules {
+		id := matched.Rule().ID()
+		if _, ok := seen[id]; ok || id == 0 {
+			continue
+		}
+		seen[id] = struct{}{}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func marshalJSON(v interface{}) (string, error) {
+	if encoded, ok := v.(jsonValue); ok {
+		return string(encoded), nil
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
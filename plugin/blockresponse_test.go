@@ -0,0 +1,121 @@
+package main
+
+import "testing"
+
+func TestBlockResponseFormat(t *testing.T) {
+	r, err := newBlockResponse("waf1", &BlockResponse{HTML: "<p>blocked</p>", JSON: `{"blocked":true}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", contentTypeHTML},
+		{"text/html", contentTypeHTML},
+		{"application/json", contentTypeJSON},
+		{"APPLICATION/JSON", contentTypeJSON},
+		{"application/problem+json", contentTypeJSON},
+		{"application/*", contentTypeJSON},
+		{"*/*", contentTypeHTML},
+		// HTML is preferred on a tie
+		{"application/json, text/html", contentTypeHTML},
+		{"text/html;q=0.8, application/json;q=0.9", contentTypeJSON},
+		{"application/json;q=0.5, text/*", contentTypeHTML},
+		// a specific media type outweighs the wildcards of the same quality
+		{"*/*, application/json", contentTypeJSON},
+		{"text/*, application/json", contentTypeJSON},
+		{"*/*;q=0.9, application/json;q=0.5", contentTypeHTML},
+		// q=0 refuses the media type
+		{"text/html;q=0, application/json;q=0.1", contentTypeJSON},
+		// the malformed media ranges and qualities are ignored
+		{"application/json;q=abc", contentTypeHTML},
+		{"application/json;;, image/png", contentTypeHTML},
+		{"image/png", contentTypeHTML},
+	}
+	for _, test := range tests {
+		if got := r.format(test.accept); got != test.want {
+			t.Errorf("format(%q) = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestBlockResponseSingleFormat(t *testing.T) {
+	tests := []struct {
+		config BlockResponse
+		accept string
+		want   string
+	}{
+		{BlockResponse{HTML: "<p>blocked</p>"}, "application/json", contentTypeHTML},
+		{BlockResponse{JSON: `{"blocked":true}`}, "text/html", contentTypeJSON},
+		{BlockResponse{Status: 429}, "text/html", ""},
+	}
+	for _, test := range tests {
+		r, err := newBlockResponse("waf1", &test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.format(test.accept); got != test.want {
+			t.Errorf("%+v format(%q) = %q, want %q", test.config, test.accept, got, test.want)
+		}
+	}
+}
+
+func TestBlockResponseRender(t *testing.T) {
+	r, err := newBlockResponse("waf1", &BlockResponse{
+		HTML: "<p>{{.TransactionID}} {{range .RuleIDs}}{{.}} {{end}}{{.Status}}</p>",
+		JSON: `{"id":{{json .TransactionID}},"rules":{{json .RuleIDs}},"status":{{.Status}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := blockResponseData{TransactionID: `<script>"x"</script>`, RuleIDs: []int{941100, 942100}, Status: 403}
+	// the values of the json template are encoded without the json function
+	plain, err := newBlockResponse("waf1", &BlockResponse{JSON: `{"id":{{.TransactionID}},"rules":{{.RuleIDs}},"status":{{.Status}},"timestamp":{{.Timestamp}}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		r           *blockResponse
+		accept      string
+		body        string
+		contentType string
+	}{
+		// the HTML template escapes the values, the json function encodes them once
+		{r, "text/html", "<p>&lt;script&gt;&#34;x&#34;&lt;/script&gt; 941100 942100 403</p>", contentTypeHTML},
+		{r, "application/json", `{"id":"\u003cscript\u003e\"x\"\u003c/script\u003e","rules":[941100,942100],"status":403}`, contentTypeJSON},
+		{plain, "application/json", `{"id":"\u003cscript\u003e\"x\"\u003c/script\u003e","rules":[941100,942100],"status":403,"timestamp":""}`, contentTypeJSON},
+	}
+	for _, test := range tests {
+		body, contentType, err := test.r.render(test.accept, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != test.body || contentType != test.contentType {
+			t.Errorf("render(%q) = %q, %q, want %q, %q", test.accept, body, contentType, test.body, test.contentType)
+		}
+	}
+}
+
+func TestNewBlockResponse(t *testing.T) {
+	tests := []struct {
+		config BlockResponse
+		ok     bool
+	}{
+		{BlockResponse{}, true},
+		{BlockResponse{Status: 302}, true},
+		{BlockResponse{Status: 599}, true},
+		// a blocked request cannot succeed
+		{BlockResponse{Status: 200}, false},
+		{BlockResponse{Status: 204}, false},
+		{BlockResponse{Status: 199}, false},
+		{BlockResponse{Status: 600}, false},
+		{BlockResponse{HTML: "{{.TransactionID"}, false},
+		{BlockResponse{JSON: "{{unknown .Status}}"}, false},
+	}
+	for _, test := range tests {
+		if _, err := newBlockResponse("waf1", &test.config); (err == nil) != test.ok {
+			t.Errorf("newBlockResponse(%+v) = %v", test.config, err)
+		}
+	}
+}
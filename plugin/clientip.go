@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"net/netip"
+	"strings"
+)
+
+const (
+	// clientIPSourceRemoteAddress uses the downstream remote address of Envoy, the default
+	clientIPSourceRemoteAddress = "remote_address"
+	// clientIPSourceProxyProtocol uses the address of the PROXY protocol header, which the proxy_protocol
+	// listener filter sets as the downstream remote address
+	clientIPSourceProxyProtocol = "proxy_protocol"
+	clientIPSourceXForwardedFor = "x_forwarded_for"
+	clientIPSourceXRealIP       = "x_real_ip"
+)
+
+// ClientIP configures the address of the client given to the transaction, REMOTE_ADDR of the rules
+type ClientIP struct {
+	// Source is remote_address, proxy_protocol, x_forwarded_for or x_real_ip
+	Source string `json:"source"`
+	// TrustedProxies are the addresses and CIDRs of the proxies allowed to set the header of the source
+	TrustedProxies []string `json:"trusted_proxies"`
+	// TrustedHops is the number of trusted proxies appending to X-Forwarded-For in front of Envoy,
+	// by default the entries of the trusted proxies are skipped from the right
+	TrustedHops int `json:"trusted_hops"`
+}
+
+// clientIPResolver resolves the client address from the header of the source. The address of a request carrying
+// the header does not resolve when the peer of Envoy, or one of the trusted hops, is not a trusted proxy.
+type clientIPResolver struct {
+	source         string
+	trustedProxies []netip.Prefix
+	trustedHops    int
+}
+
+func newClientIPResolver(config *ClientIP) (*clientIPResolver, error) {
+	r := &clientIPResolver{source: config.Source, trustedHops: config.TrustedHops}
+	switch config.Source {
+	case "", clientIPSourceRemoteAddress, clientIPSourceProxyProtocol:
+		return r, nil
+	case clientIPSourceXForwardedFor, clientIPSourceXRealIP:
+	default:
+		return nil, errors.New(fmt.Sprintf("client_ip source %s is not supported, use %s, %s, %s or %s", config.Source,
+			clientIPSourceRemoteAddress, clientIPSourceProxyProtocol, clientIPSourceXForwardedFor, clientIPSourceXRealIP))
+	}
+	if len(config.TrustedProxies) == 0 {
+		return nil, errors.New(fmt.Sprintf("client_ip source %s requires trusted_proxies", config.Source))
+	}
+	if config.TrustedHops < 0 {
+		return nil, errors.New("client_ip trusted_hops must not be negative")
+	}
+	for _, proxy := range config.TrustedProxies {
+		prefix, err := parsePrefix(proxy)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("client_ip trusted_proxies %s is not an address or a CIDR", proxy))
+		}
+		r.trustedProxies = append(r.trustedProxies, prefix)
+	}
+	return r, nil
+}
+
+// parsePrefix parses a CIDR, an address is parsed as the CIDR of the single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (r *clientIPResolver) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range r.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the address of the client, the peer when the source is not a header or when the request carries
+// no header, and an error when a hop of the request is not a trusted proxy or an entry it reads is malformed
+func (r *clientIPResolver) resolve(peer string, headerMap api.RequestHeaderMap) (string, error) {
+	if r == nil || (r.source != clientIPSourceXForwardedFor && r.source != clientIPSourceXRealIP) {
+		return peer, nil
+	}
+	header := "x-forwarded-for"
+	if r.source == clientIPSourceXRealIP {
+		header = "x-real-ip"
+	}
+	if _, ok := headerMap.Get(header); !ok {
+		return peer, nil
+	}
+	peerAddr, err := netip.ParseAddr(peer)
+	if err != nil || !r.trusted(peerAddr) {
+		return "", errors.New(fmt.Sprintf("peer %s sending %s is not a trusted proxy", peer, header))
+	}
+	if r.source == clientIPSourceXRealIP {
+		realIP, _ := headerMap.Get(header)
+		addr, err := netip.ParseAddr(strings.TrimSpace(realIP))
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("X-Real-IP %s is not an address", realIP))
+		}
+		return addr.Unmap().String(), nil
+	}
+	var entries []string
+	for _, value := range headerMap.Values(header) {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); len(entry) != 0 {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return peer, nil
+	}
+	// the entries are parsed from the right up to the client, the ones on its left are set by the client and ignored
+	if r.trustedHops > 0 {
+		// the peer appended the last entry, each of the trusted_hops-1 entries before it was appended by a trusted proxy
+		if len(entries) < r.trustedHops {
+			return "", errors.New(fmt.Sprintf("X-Forwarded-For has %d entries, fewer than the %d trusted hops", len(entries), r.trustedHops))
+		}
+		for _, entry := range entries[len(entries)-r.trustedHops+1:] {
+			hop, err := parseForwardedFor(entry)
+			if err != nil {
+				return "", err
+			}
+			if !r.trusted(hop) {
+				return "", errors.New(fmt.Sprintf("X-Forwarded-For hop %s is not a trusted proxy", hop))
+			}
+		}
+		client, err := parseForwardedFor(entries[len(entries)-r.trustedHops])
+		if err != nil {
+			return "", err
+		}
+		return client.String(), nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		hop, err := parseForwardedFor(entries[i])
+		if err != nil {
+			return "", err
+		}
+		if i == 0 || !r.trusted(hop) {
+			return hop.String(), nil
+		}
+	}
+	return peer, nil
+}
+
+// parseForwardedFor parses an entry of X-Forwarded-For, some proxies append the port of the address
+func parseForwardedFor(entry string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		addrPort, portErr := netip.ParseAddrPort(entry)
+		if portErr != nil {
+			return netip.Addr{}, errors.New(fmt.Sprintf("X-Forwarded-For entry %s is not an address", entry))
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap(), nil
+}
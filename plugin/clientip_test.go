@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"testing"
+)
+
+// testHeaderMap is a request header map holding the values by lower case name
+type testHeaderMap struct {
+	api.RequestHeaderMap
+	values map[string][]string
+}
+
+func (h testHeaderMap) Get(name string) (string, bool) {
+	values, ok := h.values[name]
+	if !ok {
+		return "", false
+	}
+	return values[0], true
+}
+
+func (h testHeaderMap) Values(name string) []string {
+	return h.values[name]
+}
+
+func TestClientIPResolverXForwardedFor(t *testing.T) {
+	tests := []struct {
+		name        string
+		trustedHops int
+		peer        string
+		xff         []string
+		want        string
+		ok          bool
+	}{
+		{"no header", 0, "203.0.113.7", nil, "203.0.113.7", true},
+		{"untrusted peer", 0, "203.0.113.7", []string{"198.51.100.1"}, "", false},
+		{"single entry", 0, "10.0.0.1", []string{"198.51.100.1"}, "198.51.100.1", true},
+		{"trusted entries skipped", 0, "10.0.0.1", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1", true},
+		// the leftmost entries are set by the client, the rightmost untrusted entry is the client
+		{"spoofed leftmost entry", 0, "10.0.0.1", []string{"1.1.1.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1", true},
+		{"spoofed trusted entry", 0, "10.0.0.1", []string{"10.0.0.9, 198.51.100.1"}, "198.51.100.1", true},
+		{"all trusted", 0, "10.0.0.1", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2", true},
+		{"several headers", 0, "10.0.0.1", []string{"1.1.1.1", "198.51.100.1, 10.0.0.2"}, "198.51.100.1", true},
+		{"entry with port", 0, "10.0.0.1", []string{"198.51.100.1:4321"}, "198.51.100.1", true},
+		{"IPv6 entry with port", 0, "10.0.0.1", []string{"[2001:db8::1]:4321"}, "2001:db8::1", true},
+		{"IPv4-mapped entry", 0, "::ffff:10.0.0.1", []string{"::ffff:198.51.100.1, ::ffff:10.0.0.2"}, "198.51.100.1", true},
+		{"empty entries", 0, "10.0.0.1", []string{" , 198.51.100.1 ,, "}, "198.51.100.1", true},
+		{"empty header", 0, "10.0.0.1", []string{""}, "10.0.0.1", true},
+		{"malformed entry", 0, "10.0.0.1", []string{"198.51.100.1, unknown"}, "", false},
+		{"malformed trusted entry", 0, "10.0.0.1", []string{"unknown, 10.0.0.2"}, "", false},
+		// the entries on the left of the client are not read
+		{"malformed leftmost entry", 0, "10.0.0.1", []string{"<script>, 198.51.100.1"}, "198.51.100.1", true},
+		{"one trusted hop", 1, "10.0.0.1", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1", true},
+		{"malformed entry beyond the hops", 1, "10.0.0.1", []string{"unknown, 198.51.100.1"}, "198.51.100.1", true},
+		{"malformed client entry", 2, "10.0.0.1", []string{"unknown, 10.0.0.2"}, "", false},
+		{"malformed hop", 2, "10.0.0.1", []string{"198.51.100.1, unknown"}, "", false},
+		{"two trusted hops", 2, "10.0.0.1", []string{"1.1.1.1, 198.51.100.1, 10.0.0.2"}, "198.51.100.1", true},
+		// the trusted hops are counted, not skipped by address
+		{"hops counted", 2, "10.0.0.1", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "10.0.0.2", true},
+		{"untrusted hop", 2, "10.0.0.1", []string{"1.1.1.1, 198.51.100.1, 203.0.113.7"}, "", false},
+		{"fewer entries than hops", 3, "10.0.0.1", []string{"198.51.100.1, 10.0.0.2"}, "", false},
+	}
+	r, err := newClientIPResolver(&ClientIP{Source: clientIPSourceXForwardedFor, TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		r.trustedHops = test.trustedHops
+		headers := testHeaderMap{values: make(map[string][]string)}
+		if test.xff != nil {
+			headers.values["x-forwarded-for"] = test.xff
+		}
+		got, err := r.resolve(test.peer, headers)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("%s: resolve = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestClientIPResolverXRealIP(t *testing.T) {
+	tests := []struct {
+		peer   string
+		realIP string
+		want   string
+		ok     bool
+	}{
+		{"10.0.0.1", " 198.51.100.1 ", "198.51.100.1", true},
+		{"10.0.0.1", "::ffff:198.51.100.1", "198.51.100.1", true},
+		{"10.0.0.1", "198.51.100.1, 1.1.1.1", "", false},
+		{"203.0.113.7", "198.51.100.1", "", false},
+		{"not an address", "198.51.100.1", "", false},
+	}
+	r, err := newClientIPResolver(&ClientIP{Source: clientIPSourceXRealIP, TrustedProxies: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		got, err := r.resolve(test.peer, testHeaderMap{values: map[string][]string{"x-real-ip": {test.realIP}}})
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("resolve(%q, %q) = %q, %v, want %q", test.peer, test.realIP, got, err, test.want)
+		}
+	}
+}
+
+func TestNewClientIPResolver(t *testing.T) {
+	tests := []struct {
+		config ClientIP
+		ok     bool
+	}{
+		{ClientIP{}, true},
+		{ClientIP{Source: clientIPSourceProxyProtocol}, true},
+		{ClientIP{Source: clientIPSourceXForwardedFor, TrustedProxies: []string{"10.0.0.0/8", "2001:db8::1"}, TrustedHops: 2}, true},
+		{ClientIP{Source: "forwarded"}, false},
+		{ClientIP{Source: clientIPSourceXForwardedFor}, false},
+		{ClientIP{Source: clientIPSourceXForwardedFor, TrustedProxies: []string{"10.0.0.0/33"}}, false},
+		{ClientIP{Source: clientIPSourceXRealIP, TrustedProxies: []string{"proxy"}}, false},
+		{ClientIP{Source: clientIPSourceXForwardedFor, TrustedProxies: []string{"10.0.0.1"}, TrustedHops: -1}, false},
+	}
+	for _, test := range tests {
+		if _, err := newClientIPResolver(&test.config); (err == nil) != test.ok {
+			t.Errorf("newClientIPResolver(%+v) = %v", test.config, err)
+		}
+	}
+	// without a header source the peer is the client
+	var r *clientIPResolver
+	if got, err := r.resolve("203.0.113.7", testHeaderMap{}); got != "203.0.113.7" || err != nil {
+		t.Errorf("nil resolver resolve = %q, %v", got, err)
+	}
+}
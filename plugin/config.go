@@ -1,19 +1,45 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"net/http"
 )
 
+const pluginName = "waf-go-envoy"
+
+// lintOnly is set by the config linter, the configurations are parsed without opening their listeners, files and sockets
+var lintOnly bool
+
 func configFactory(c interface{}) api.StreamFilterFactory {
 	conf, ok := c.(*configuration)
 	if !ok {
-		panic("unexpected config type")
+		err, ok := c.(error)
+		if !ok {
+			err = errors.New(fmt.Sprintf("unexpected config type %T", c))
+		}
+		api.LogError(BuildLoggerMessage().err(err).msg("Invalid configuration, rejecting the requests"))
+		return func(callbacks api.FilterCallbackHandler) api.StreamFilter {
+			return &configErrorFilter{callbacks: callbacks}
+		}
 	}
 	return func(callbacks api.FilterCallbackHandler) api.StreamFilter {
 		return &filter{
 			callbacks: callbacks,
-			wafMaps:   conf.wafMaps,
+			wafMaps:   *conf.wafMaps.Load(),
 			conf:      *conf,
 		}
 	}
 }
+
+// configErrorFilter rejects the requests of a configuration which cannot be applied, they would not be inspected
+type configErrorFilter struct {
+	api.PassThroughStreamFilter
+	callbacks api.FilterCallbackHandler
+}
+
+func (f *configErrorFilter) DecodeHeaders(api.RequestHeaderMap, bool) api.StatusType {
+	f.callbacks.SendLocalReply(http.StatusInternalServerError, "", map[string]string{}, 0, "WAF configuration error")
+	return api.LocalReply
+}
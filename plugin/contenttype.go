@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// contentTypes is the allowlist of the media types whose bodies are inspected, a nil allowlist inspects every body.
+// The patterns are media types ("application/json"), type wildcards ("text/*"), suffix wildcards ("application/*+json")
+// or "*/*".
+type contentTypes []string
+
+func newContentTypes(name, key string, patterns []string) (contentTypes, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	c := make(contentTypes, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		slash := strings.Index(pattern, "/")
+		if slash <= 0 || slash == len(pattern)-1 || strings.Contains(pattern[:slash], "*") && pattern != "*/*" {
+			return nil, errors.New(fmt.Sprintf("%s %s pattern %s is not a media type", name, key, pattern))
+		}
+		// the subtype is matched whole, by "*" or by a "*+suffix" wildcard only
+		if subtype := pattern[slash+1:]; subtype != "*" && strings.Contains(subtype, "*") &&
+			(!strings.HasPrefix(subtype, "*+") || len(subtype) == 2 || strings.Contains(subtype[1:], "*")) {
+			return nil, errors.New(fmt.Sprintf("%s %s pattern %s is not supported, use a type wildcard like text/* or a suffix wildcard like application/*+json", name, key, pattern))
+		}
+		c = append(c, pattern)
+	}
+	return c, nil
+}
+
+// match reports whether the body of the Content-Type is inspected, a body without Content-Type always is
+func (c contentTypes) match(contentType string) bool {
+	if c == nil || len(contentType) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(strings.ToLower(contentType), ";")
+		mediaType = strings.TrimSpace(mediaType)
+	}
+	for _, pattern := range c {
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		wildcard := strings.Index(pattern, "/*")
+		if wildcard < 0 {
+			continue
+		}
+		prefix, suffix := pattern[:wildcard+1], pattern[wildcard+2:]
+		if len(mediaType) > len(prefix)+len(suffix) && strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestContentTypes(t *testing.T) {
+	c, err := newContentTypes("waf1", "request_body_content_types", []string{"application/json", " Text/* ", "application/*+xml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"Application/JSON; charset=utf-8", true},
+		{"text/plain", true},
+		{"text/html;charset=\"utf-8\"", true},
+		{"application/soap+xml", true},
+		{"application/xml", false},
+		// the wildcard needs a subtype
+		{"text/", false},
+		{"application/+xml", false},
+		{"application/jsonp", false},
+		{"image/png", false},
+		{"multipart/form-data; boundary=x", false},
+		// a malformed Content-Type is matched by its media type
+		{"application/json; charset", true},
+		{"image/png;;", false},
+		// a body without Content-Type is always inspected
+		{"", true},
+	}
+	for _, test := range tests {
+		if got := c.match(test.contentType); got != test.want {
+			t.Errorf("match(%q) = %v, want %v", test.contentType, got, test.want)
+		}
+	}
+	all, err := newContentTypes("waf1", "response_body_content_types", []string{"*/*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all.match("image/png") {
+		t.Error("*/* does not match image/png")
+	}
+	var none contentTypes
+	if !none.match("image/png") {
+		t.Error("a nil allowlist does not inspect image/png")
+	}
+}
+
+func TestNewContentTypes(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		ok       bool
+	}{
+		{nil, true},
+		{[]string{"application/json", "text/*", "application/*+json", "*/*"}, true},
+		{[]string{"json"}, false},
+		{[]string{"/json"}, false},
+		{[]string{"application/"}, false},
+		{[]string{"*/json"}, false},
+		{[]string{"app*/json"}, false},
+		// the wildcards within a subtype never match, they are rejected
+		{[]string{"application/vnd.*"}, false},
+		{[]string{"application/*json"}, false},
+		{[]string{"application/*+"}, false},
+		{[]string{"application/*+*"}, false},
+		{[]string{"application/json*"}, false},
+	}
+	for _, test := range tests {
+		c, err := newContentTypes("waf1", "request_body_content_types", test.patterns)
+		if (err == nil) != test.ok {
+			t.Errorf("newContentTypes(%q) = %v", test.patterns, err)
+		}
+		if test.patterns == nil && c != nil {
+			t.Error("no pattern is not a nil allowlist")
+		}
+	}
+}
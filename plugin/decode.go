@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decodeConfigField decodes the key of the plugin config into out, it returns false when the key is absent.
+// The value is either a JSON-encoded string or the native struct or list of the TypedStruct,
+// the errors name the bad key, and for the string form the line and column in the string as well. The unknown keys
+// are errors, a misspelled key would otherwise be silently ignored.
+func decodeConfigField(v map[string]interface{}, key string, out interface{}) (bool, error) {
+	value, ok := v[key]
+	if !ok {
+		return false, nil
+	}
+	data, encoded := value.(string)
+	if !encoded {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return true, errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+		}
+		data = string(b)
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(out); err != nil {
+		return true, configFieldError(key, data, encoded, err)
+	}
+	return true, nil
+}
+
+func configFieldError(key, data string, encoded bool, err error) error {
+	var (
+		syntaxError *json.SyntaxError
+		typeError   *json.UnmarshalTypeError
+		path        = key
+		offset      int64
+		msg         string
+	)
+	switch {
+	case errors.As(err, &syntaxError):
+		offset, msg = syntaxError.Offset, syntaxError.Error()
+	case errors.As(err, &typeError):
+		if len(typeError.Field) != 0 {
+			path = key + "." + typeError.Field
+		}
+		offset, msg = typeError.Offset, fmt.Sprintf("expected %s but got %s", typeError.Type.String(), typeError.Value)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		offset, msg = int64(len(data)), "unexpected end of JSON input"
+	case errors.Is(err, io.EOF):
+		return errors.New(fmt.Sprintf("%s: is empty", key))
+	case strings.HasPrefix(err.Error(), unknownFieldPrefix):
+		field := strings.TrimSuffix(strings.TrimPrefix(err.Error(), unknownFieldPrefix), `"`)
+		var ok bool
+		if path, offset, ok = fieldPath(key, data, field); !ok {
+			path, offset = key, int64(len(data))
+		}
+		msg = fmt.Sprintf("unknown key %s", field)
+	default:
+		return errors.New(fmt.Sprintf("%s: %s", key, err.Error()))
+	}
+	if !encoded {
+		return errors.New(fmt.Sprintf("%s: %s", path, msg))
+	}
+	line, column := lineColumn(data, offset)
+	return errors.New(fmt.Sprintf("%s: line %d, column %d: %s", path, line, column, msg))
+}
+
+// unknownFieldPrefix starts the error of json.Decoder.DisallowUnknownFields, which has no error type
+const unknownFieldPrefix = `json: unknown field "`
+
+// fieldPath returns the path and the offset of the first object key named field in data
+func fieldPath(key, data, field string) (string, int64, bool) {
+	type frame struct {
+		object    bool
+		expectKey bool
+		key       string
+		index     int
+	}
+	var stack []*frame
+	// next moves the innermost container past a value
+	next := func() {
+		if len(stack) == 0 {
+			return
+		}
+		if top := stack[len(stack)-1]; top.object {
+			top.expectKey = true
+		} else {
+			top.index++
+		}
+	}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return "", 0, false
+		}
+		if len(stack) != 0 && stack[len(stack)-1].object && stack[len(stack)-1].expectKey {
+			top := stack[len(stack)-1]
+			if name, ok := token.(string); ok {
+				top.key, top.expectKey = name, false
+				if name != field {
+					continue
+				}
+				path := key
+				for _, f := range stack {
+					if f.object {
+						path += "." + f.key
+					} else {
+						path += fmt.Sprintf("[%d]", f.index)
+					}
+				}
+				// the offset ends the previous token, the key starts at the next quote
+				return path, offset + int64(strings.IndexByte(data[offset:], '"')), true
+			}
+		}
+		switch token {
+		case json.Delim('{'):
+			stack = append(stack, &frame{object: true, expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &frame{})
+		case json.Delim('}'), json.Delim(']'):
+			stack = stack[:len(stack)-1]
+			next()
+		default:
+			next()
+		}
+	}
+}
+
+// lineColumn converts the byte offset of data to a 1-based line and column
+func lineColumn(data string, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, column := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+			continue
+		}
+		column++
+	}
+	return line, column
+}
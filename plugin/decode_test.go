@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestDecodeConfigFieldErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "unknown key in a string",
+			value: "{\n  \"waf1\": {\n    \"simple_directive\": []\n  }\n}",
+			want:  "directives.waf1.simple_directive: line 3, column 5: unknown key simple_directive",
+		},
+		{
+			name:  "unknown key in a struct",
+			value: map[string]interface{}{"waf1": map[string]interface{}{"simple_directive": []interface{}{}}},
+			want:  "directives.waf1.simple_directive: unknown key simple_directive",
+		},
+		{
+			name:  "unexpected EOF",
+			value: `{"waf1": {"simple_directives": ["a"]`,
+			want:  "directives: line 1, column 37: unexpected end of JSON input",
+		},
+		{
+			name:  "empty string",
+			value: "",
+			want:  "directives: is empty",
+		},
+		{
+			name:  "type error",
+			value: `{"waf1": {"simple_directives": "a"}}`,
+			want:  "directives.waf1.simple_directives: line 1, column 35: expected []string but got string",
+		},
+		{
+			name:  "syntax error",
+			value: "{\"waf1\": {\"simple_directives\": [\"a\",]}}",
+			want:  "directives: line 1, column 38: invalid character ']' looking for beginning of value",
+		},
+	}
+	for _, test := range tests {
+		var directives WafDirectives
+		_, err := decodeConfigField(map[string]interface{}{"directives": test.value}, "directives", &directives)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.want)
+		}
+	}
+}
+
+func TestDecodeConfigFieldUnknownKeyInList(t *testing.T) {
+	var routes RouteDirectiveMap
+	_, err := decodeConfigField(map[string]interface{}{"route_directive_map": "[{\"directive\":\"a\"},\n {\"path\":\"/x\"}]"}, "route_directive_map", &routes)
+	want := "route_directive_map[1].path: line 2, column 3: unknown key path"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %s", err, want)
+	}
+}
+
+func TestDecodeConfigField(t *testing.T) {
+	var directives WafDirectives
+	ok, err := decodeConfigField(map[string]interface{}{"directives": map[string]interface{}{
+		"waf1": map[string]interface{}{"simple_directives": []interface{}{"SecRuleEngine On"}},
+	}}, "directives", &directives)
+	if !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	if got := directives["waf1"].SimpleDirectives; len(got) != 1 || got[0] != "SecRuleEngine On" {
+		t.Errorf("got %v", got)
+	}
+	if ok, err := decodeConfigField(map[string]interface{}{}, "directives", &directives); ok || err != nil {
+		t.Errorf("absent key: got %v, %v", ok, err)
+	}
+}
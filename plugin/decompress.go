@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"io"
+	"strings"
+)
+
+// defaultMaxDecompressedBodySize caps the decompressed body written to the transaction, against zip bombs
+const defaultMaxDecompressedBodySize = 10 * 1024 * 1024
+
+// bodyDecoder decompresses a body encoded with Content-Encoding for the inspection, the body forwarded
+// is left untouched. The compressed chunks are collected until the end of the body, at most maxSize
+// bytes of them, and the decompressed body is truncated to maxSize bytes.
+type bodyDecoder struct {
+	encodings  []string
+	maxSize    int
+	compressed bytes.Buffer
+	truncated  bool
+}
+
+// newBodyDecoder returns nil when the body is not compressed, or compressed with an unsupported encoding
+func newBodyDecoder(contentEncoding string, maxSize int) *bodyDecoder {
+	var encodings []string
+	for _, encoding := range strings.Split(contentEncoding, ",") {
+		encoding = strings.ToLower(strings.TrimSpace(encoding))
+		switch encoding {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate", "br":
+			encodings = append(encodings, encoding)
+		default:
+			return nil
+		}
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+	return &bodyDecoder{encodings: encodings, maxSize: maxSize}
+}
+
+func (d *bodyDecoder) write(chunk []byte) {
+	if room := d.maxSize - d.compressed.Len(); len(chunk) > room {
+		chunk = chunk[:room]
+		d.truncated = true
+	}
+	d.compressed.Write(chunk)
+}
+
+// decode returns the decompressed body, truncated to maxSize. On a decoding error the body decoded so far
+// is returned along with the error.
+func (d *bodyDecoder) decode() ([]byte, error) {
+	var r io.Reader = bytes.NewReader(d.compressed.Bytes())
+	// the encodings are listed in the order they were applied
+	for i := len(d.encodings) - 1; i >= 0; i-- {
+		decoder, err := newDecoder(d.encodings[i], r)
+		if err != nil {
+			return nil, err
+		}
+		r = decoder
+	}
+	var decoded bytes.Buffer
+	n, err := io.Copy(&decoded, io.LimitReader(r, int64(d.maxSize)+1))
+	if n > int64(d.maxSize) {
+		d.truncated = true
+		decoded.Truncate(d.maxSize)
+		err = nil
+	} else if d.truncated {
+		// the compressed body itself was truncated, its end is missing
+		err = nil
+	}
+	if err != nil {
+		return decoded.Bytes(), errors.New(fmt.Sprintf("%s body decoding error:%s", strings.Join(d.encodings, ","), err.Error()))
+	}
+	return decoded.Bytes(), nil
+}
+
+func newDecoder(encoding string, r io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// deflate is zlib wrapped, though some servers send raw deflate
+		buffered := bufio.NewReader(r)
+		header, err := buffered.Peek(2)
+		if err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(buffered)
+		}
+		return flate.NewReader(buffered), nil
+	case "br":
+		return brotli.NewReader(r), nil
+	}
+	return nil, errors.New(fmt.Sprintf("content encoding %s is not supported", encoding))
+}
+
+// decodeBody returns the decompressed body. On a decoding error it returns the part decoded followed by the body
+// as received, a body which does not decode is inspected as it is forwarded.
+func (f *filter) decodeBody(decoder *bodyDecoder) ([]byte, error) {
+	if decoder.compressed.Len() == 0 {
+		return nil, nil
+	}
+	body, err := decoder.decode()
+	if err != nil {
+		f.logStream(api.Info, f.log().err(err).msg("Failed to decompress body, inspecting it as received"))
+		body = append(body, decoder.compressed.Bytes()...)
+	}
+	if decoder.truncated {
+		f.logStream(api.Info, f.log().int("max_decompressed_body_size", decoder.maxSize).msg("Decompressed body truncated, inspecting its beginning"))
+	}
+	return body, err
+}
+
+// writeDecodedRequestBody writes the decompressed request body to the transaction once the compressed body is complete,
+// it reports whether the request was interrupted or rejected by the on_error policy
+func (f *filter) writeDecodedRequestBody() (api.StatusType, bool) {
+	decoder := f.requestBodyDecoder
+	if decoder == nil {
+		return api.Continue, false
+	}
+	f.requestBodyDecoder = nil
+	body, err := f.decodeBody(decoder)
+	if err != nil {
+		// the body as received is inspected when the policy is open
+		if status, rejected := f.onError("Decompress"); rejected {
+			return status, true
+		}
+	}
+	f.shadow.writeRequestBody(body, true)
+	if len(body) == 0 {
+		return api.Continue, false
+	}
+	interruption, _, err := f.tx.WriteRequestBody(body)
+	if err != nil {
+		f.logStream(api.Info, f.log().err(err).msg("Failed to write request body"))
+		status, rejected := f.onError("WriteRequestBody")
+		return status, rejected
+	}
+	if interruption != nil {
+		f.logStream(api.Info, f.log().msg("RequestBody is over limit"))
+		metrics.bodyTooLarge.inc(f.directive, f.host, phaseRequestBody)
+		return f.interrupt(interruption, "RequestBody is over limit"), true
+	}
+	return api.Continue, false
+}
+
+// writeDecodedResponseBody writes the decompressed response body to the transaction once the compressed body is complete,
+// it reports whether the response was interrupted or rejected by the on_error policy
+func (f *filter) writeDecodedResponseBody() (api.StatusType, bool) {
+	decoder := f.responseBodyDecoder
+	if decoder == nil {
+		return api.Continue, false
+	}
+	f.responseBodyDecoder = nil
+	body, err := f.decodeBody(decoder)
+	if err != nil {
+		// the body as received is inspected when the policy is open
+		if status, rejected := f.onError("Decompress"); rejected {
+			return status, true
+		}
+	}
+	f.shadow.writeResponseBody(body, true)
+	if len(body) == 0 {
+		return api.Continue, false
+	}
+	interruption, _, err := f.tx.WriteResponseBody(body)
+	if err != nil {
+		f.logStream(api.Info, f.log().err(err).msg("Failed to write response body"))
+		status, rejected := f.onError("WriteResponseBody")
+		return status, rejected
+	}
+	if interruption != nil {
+		f.logStream(api.Info, f.log().msg("ResponseBody is over limit"))
+		metrics.bodyTooLarge.inc(f.directive, f.host, phaseResponseBody)
+		return f.interrupt(interruption, "ResponseBody is over limit"), true
+	}
+	return api.Continue, false
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"io"
+	"strings"
+	"testing"
+)
+
+func compress(t *testing.T, encoding string, body []byte) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&b)
+	case "deflate":
+		w = zlib.NewWriter(&b)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&b, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&b)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestNewBodyDecoder(t *testing.T) {
+	tests := []struct {
+		contentEncoding string
+		want            []string
+	}{
+		{"", nil},
+		{"identity", nil},
+		{"gzip", []string{"gzip"}},
+		{"X-GZIP", []string{"x-gzip"}},
+		{" deflate , br ", []string{"deflate", "br"}},
+		{"identity, gzip", []string{"gzip"}},
+		// a body with an unsupported encoding is inspected as received
+		{"zstd", nil},
+		{"gzip, compress", nil},
+	}
+	for _, test := range tests {
+		d := newBodyDecoder(test.contentEncoding, 1024)
+		var got []string
+		if d != nil {
+			got = d.encodings
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || (d == nil) != (test.want == nil) {
+			t.Errorf("newBodyDecoder(%q) = %q, want %q", test.contentEncoding, got, test.want)
+		}
+	}
+}
+
+func TestBodyDecoderDecode(t *testing.T) {
+	body := []byte(strings.Repeat("id=1 UNION SELECT password FROM users;", 100))
+	gzipped := compress(t, "gzip", body)
+	tests := []struct {
+		name            string
+		contentEncoding string
+		compressed      []byte
+		maxSize         int
+		want            []byte
+		truncated       bool
+	}{
+		{"gzip", "gzip", gzipped, len(body), body, false},
+		{"deflate", "deflate", compress(t, "deflate", body), len(body), body, false},
+		{"raw deflate", "deflate", compress(t, "raw-deflate", body), len(body), body, false},
+		{"brotli", "br", compress(t, "br", body), len(body), body, false},
+		// the encodings are undone in the reverse order
+		{"gzip then brotli", "gzip, br", compress(t, "br", gzipped), len(body), body, false},
+		// the decompressed body over the limit is truncated
+		{"decompressed over the limit", "gzip", gzipped, 100, body[:100], true},
+		// the compressed body over the limit is decoded as far as it goes, without error
+		{"compressed over the limit", "gzip", gzipped, 40, body, true},
+	}
+	for _, test := range tests {
+		d := newBodyDecoder(test.contentEncoding, test.maxSize)
+		// the body arrives in chunks
+		for chunk := test.compressed; len(chunk) != 0; {
+			n := 7
+			if len(chunk) < n {
+				n = len(chunk)
+			}
+			d.write(chunk[:n])
+			chunk = chunk[n:]
+		}
+		got, err := d.decode()
+		if err != nil {
+			t.Errorf("%s: decode error:%s", test.name, err.Error())
+			continue
+		}
+		if test.truncated {
+			if !bytes.HasPrefix(test.want, got) || len(got) > test.maxSize {
+				t.Errorf("%s: decode = %d bytes, not a prefix of the body within %d bytes", test.name, len(got), test.maxSize)
+			}
+		} else if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: decode = %q", test.name, got)
+		}
+		if d.truncated != test.truncated {
+			t.Errorf("%s: truncated = %v, want %v", test.name, d.truncated, test.truncated)
+		}
+	}
+}
+
+func TestBodyDecoderDecodeError(t *testing.T) {
+	body := []byte(strings.Repeat("<script>alert(1)</script>", 100))
+	gzipped := compress(t, "gzip", body)
+	corrupt := append([]byte(nil), gzipped...)
+	corrupt[len(corrupt)-20] ^= 0xff
+	tests := []struct {
+		name            string
+		contentEncoding string
+		compressed      []byte
+	}{
+		{"not gzip", "gzip", []byte("id=1 UNION SELECT")},
+		{"corrupt gzip", "gzip", corrupt},
+		{"missing gzip end", "gzip", gzipped[:len(gzipped)-10]},
+		{"not deflate", "deflate", []byte{0xff, 0xff, 0xff}},
+		{"not brotli", "br", []byte("id=1 UNION SELECT")},
+	}
+	for _, test := range tests {
+		d := newBodyDecoder(test.contentEncoding, 1<<20)
+		d.write(test.compressed)
+		got, err := d.decode()
+		if err == nil {
+			t.Errorf("%s: decoded", test.name)
+			continue
+		}
+		// the part decoded before the error is returned
+		if !bytes.HasPrefix(body, got) {
+			t.Errorf("%s: decode = %q, not a prefix of the body", test.name, got)
+		}
+	}
+}
@@ -8,90 +8,193 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const HOSTPOSTSEPARATOR string = ":"
 
+// maxTransactionIDLength bounds the transaction id taken from the request, it ends up in the logs and the replies
+const maxTransactionIDLength = 128
+
 type filter struct {
 	callbacks           api.FilterCallbackHandler
 	conf                configuration
 	wafMaps             wafMaps
+	directive           string
+	host                string
+	clientIP            string
 	tx                  types.Transaction
+	shadow              *shadow
 	httpProtocol        string
+	accept              string
 	isInterruption      bool
 	processRequestBody  bool
 	processResponseBody bool
+	// requestBodyDecoder and responseBodyDecoder decompress the bodies for the inspection
+	requestBodyDecoder  *bodyDecoder
+	responseBodyDecoder *bodyDecoder
+	// skipRequestBody and skipResponseBody are set when the content type of the body is not inspected
+	skipRequestBody  bool
+	skipResponseBody bool
+	// masked is set when the spans of the mask rules were redacted instead of blocking the response
+	masked bool
+	// mu serializes the async inspections of the stream, inspecting tracks them so that the transaction is closed once they are done
+	mu             sync.Mutex
+	inspecting     sync.WaitGroup
+	inspectionTime time.Duration
+	budgetExceeded bool
+	// panicked is set once an inspection panicked, see recoverInspection
+	panicked bool
+	// destroyed is set by OnDestroy, Envoy releases the stream afterwards: the callbacks must no longer be used
+	// and the inspections still queued are skipped
+	destroyed atomic.Bool
 }
 
 func (f *filter) DecodeHeaders(headerMap api.RequestHeaderMap, endStream bool) api.StatusType {
+	return f.inspect(func() api.StatusType {
+		return f.decodeHeaders(headerMap, endStream)
+	})
+}
+
+func (f *filter) decodeHeaders(headerMap api.RequestHeaderMap, endStream bool) api.StatusType {
+	if f.conf.ruleEngine == types.RuleEngineOff {
+		return api.Continue
+	}
 	var host string
 	host = headerMap.Host()
+	f.directive = f.conf.directive(host, headerMap.Path(), headerMap.Method())
 	if len(host) == 0 {
-		return api.Continue
+		// without a host only default_directive and the route rules without a host condition apply
+		f.logStream(api.Info, f.log().msg("Request without Host"))
+		if status, rejected := f.onError("Host"); rejected {
+			return status
+		}
+	}
+	peerIP, srcPortString, _ := net.SplitHostPort(f.callbacks.StreamInfo().DownstreamRemoteAddress())
+	f.clientIP = peerIP
+	srcPort, err := strconv.Atoi(srcPortString)
+	if err != nil {
+		f.logStream(api.Info, f.log().err(err).msg("RemotePort formatting error"))
+		if status, rejected := f.onError("RemotePort"); rejected {
+			return status
+		}
+		srcPort = 0
 	}
-	waf := f.conf.wafMaps[f.conf.defaultDirective]
-	ruleName, ok := f.conf.hostDirectiveMap[host]
-	if ok {
-		waf = f.conf.wafMaps[ruleName]
+	srcIP, err := f.conf.clientIPResolver.resolve(peerIP, headerMap)
+	if err != nil {
+		f.logStream(api.Info, f.log().err(err).msg("Untrusted client address, using the downstream remote address"))
+		if status, rejected := f.onError("ClientIP"); rejected {
+			return status
+		}
+		srcIP = peerIP
+	}
+	if srcIP != peerIP {
+		// the port of the client behind the proxies is unknown
+		f.clientIP = srcIP
+		srcPort = 0
+	}
+	// the allowed and blocked clients are handled before paying for a transaction
+	if list, ok := f.conf.ipLists.match(srcIP); ok {
+		metrics.ipListMatches.inc(f.directive, list)
+		f.callbacks.StreamInfo().DynamicMetadata().Set(pluginName, "ip_list", list)
+		if list == ipListAllow {
+			f.logStream(api.Debug, f.log().msg("Client allowed by ip_lists, skipping the WAF"))
+			return api.Continue
+		}
+		f.logStream(api.Info, f.log().msg("Client blocked by ip_lists"))
+		f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Client blocked by ip_lists")
+		return api.LocalReply
+	}
+	waf := f.wafMaps[f.directive]
+	if id, ok := headerMap.Get(f.conf.transactionIDHeader); ok && validTransactionID(id) {
+		f.tx = waf.NewTransactionWithID(id)
+	} else {
+		// an id set by the client is only trusted when it is a short token
+		f.tx = waf.NewTransaction()
+		if f.conf.setTransactionIDHeader {
+			headerMap.Set(f.conf.transactionIDHeader, f.tx.ID())
+		}
+	}
+	f.bindCollectionStore()
+	if len(host) != 0 {
+		// a missing Host stays missing for the rules, e.g. the CRS one detecting it
+		f.tx.AddRequestHeader("Host", host)
 	}
-	f.tx = waf.NewTransaction()
-	f.tx.AddRequestHeader("Host", host)
 	var server = host
-	var err error
 	if strings.Contains(host, HOSTPOSTSEPARATOR) {
 		server, _, err = net.SplitHostPort(host)
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().str("Host", host).err(err).msg("Failed to parse server name from Host"))
-			f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Failed to parse server name from Host")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().str("host", host).err(err).msg("Failed to parse server name from Host"))
+			if status, rejected := f.onError("ServerName"); rejected {
+				return status
+			}
+			server = host
 		}
 	}
 	f.tx.SetServerName(server)
+	f.host = strings.ToLower(server)
 	tx := f.tx
 	//X-Coraza-Rule-Engine: Off  This can be set through the request header
 	if tx.IsRuleEngineOff() {
 		return api.Continue
 	}
-	srcIP, srcPortString, _ := net.SplitHostPort(f.callbacks.StreamInfo().DownstreamRemoteAddress())
-	srcPort, err := strconv.Atoi(srcPortString)
-	if err != nil {
-		f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("RemotePort formatting error"))
-		f.callbacks.SendLocalReply(http.StatusBadRequest, "", map[string]string{}, 0, "RemotePort formatting error")
-		return api.LocalReply
-	}
+	metrics.requests.inc(f.directive, f.host)
+	defer f.observePhase(phaseRequestHeaders, time.Now())
 	destIP, destPortString, _ := net.SplitHostPort(f.callbacks.StreamInfo().DownstreamLocalAddress())
 	destPort, err := strconv.Atoi(destPortString)
 	if err != nil {
-		f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("LocalPort formatting error"))
-		f.callbacks.SendLocalReply(http.StatusBadRequest, "", map[string]string{}, 0, "LocalPort formatting error")
-		return api.LocalReply
+		f.logStream(api.Info, f.log().err(err).msg("LocalPort formatting error"))
+		if status, rejected := f.onError("LocalPort"); rejected {
+			return status
+		}
+		destPort = 0
 	}
 	tx.ProcessConnection(srcIP, srcPort, destIP, destPort)
+	geo := f.conf.geoDatabase.lookup(srcIP)
+	f.setGeo(tx, geo)
 	path := headerMap.Path()
 	method := headerMap.Method()
 	protocol := headerMap.Protocol()
 	//Maybe it's a bug? sometimes you can't get Protocol from Envoy
 	if len(protocol) == 0 {
-		f.callbacks.Log(api.Warn, BuildLoggerMessage().msg("Get protocol failed"))
+		f.logStream(api.Warn, f.log().msg("Get protocol failed"))
 		protocol = "HTTP/2.0"
 	}
 	f.httpProtocol = protocol
+	f.accept, _ = headerMap.Get("accept")
+	contentType, _ := headerMap.Get("content-type")
+	f.skipRequestBody = !f.conf.requestBodyContentTypes[f.directive].match(contentType)
+	if contentEncoding, ok := headerMap.Get("content-encoding"); ok && !f.skipRequestBody {
+		f.requestBodyDecoder = newBodyDecoder(contentEncoding, f.conf.maxDecompressedBodySize)
+	}
 	tx.ProcessURI(path, method, protocol)
 	headerMap.Range(func(key, value string) bool {
 		tx.AddRequestHeader(key, value)
 		return true
 	})
+	if shadowDirective, ok := f.conf.shadowDirective(host); ok {
+		f.shadow = newShadow(f.logStream, f.log, shadowDirective, f.wafMaps[shadowDirective], tx.ID())
+		f.setGeo(f.shadow.tx, geo)
+		f.shadow.processRequestHeaders(headerMap, host, server, srcIP, srcPort, destIP, destPort, protocol)
+	}
 	interruption := tx.ProcessRequestHeaders()
 	if interruption != nil {
-		f.isInterruption = true
-		f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessRequestHeaders failed"))
-		f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Reject because of bad request header")
-		return api.LocalReply
+		f.logStream(api.Info, f.log().msg("ProcessRequestHeaders failed"))
+		return f.interrupt(interruption, "Reject because of bad request header")
 	}
+	f.setMetadata()
 	return api.Continue
 }
 
 func (f *filter) DecodeData(buffer api.BufferInstance, endStream bool) api.StatusType {
+	return f.inspect(func() api.StatusType {
+		return f.decodeData(buffer, endStream)
+	})
+}
+
+func (f *filter) decodeData(buffer api.BufferInstance, endStream bool) api.StatusType {
 	if f.isInterruption {
 		f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Interruption already handled")
 		return api.LocalReply
@@ -106,50 +209,63 @@ func (f *filter) DecodeData(buffer api.BufferInstance, endStream bool) api.Statu
 	if tx.IsRuleEngineOff() {
 		return api.Continue
 	}
-	if !tx.IsRequestBodyAccessible() {
-		f.callbacks.Log(api.Debug, BuildLoggerMessage().msg("Skipping request body inspection, SecRequestBodyAccess is off"))
+	defer f.observePhase(phaseRequestBody, time.Now())
+	if !tx.IsRequestBodyAccessible() || f.skipRequestBody {
+		f.logStream(api.Debug, f.log().bool("content_type_inspected", !f.skipRequestBody).msg("Skipping request body inspection, SecRequestBodyAccess is off or the content type is not inspected"))
 		f.processRequestBody = true
+		// the shadow skips the bodies the enforcing transaction skips, so that their verdicts compare
+		f.shadow.processRequestBody()
 		interruption, err := tx.ProcessRequestBody()
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Failed to process request body"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("Failed to process request body"))
+			status, _ := f.onError("ProcessRequestBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessRequestBody forbidden"))
-			f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Reject because of bad request body")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().msg("ProcessRequestBody forbidden"))
+			return f.interrupt(interruption, "Reject because of bad request body")
 		}
 		return api.Continue
 	}
+	if f.requestBodyDecoder == nil {
+		f.shadow.writeRequestBody(buffer.Bytes(), endStream)
+	}
 	bodySize := buffer.Len()
-	if bodySize > 0 {
+	if bodySize > 0 && f.requestBodyDecoder != nil {
+		f.requestBodyDecoder.write(buffer.Bytes())
+	} else if bodySize > 0 {
 		bytes := buffer.Bytes()
 		interruption, _, err := tx.WriteRequestBody(bytes)
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Failed to write request body"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("Failed to write request body"))
+			status, _ := f.onError("WriteRequestBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.callbacks.Log(api.Info, BuildLoggerMessage().msg("RequestBody is over limit"))
-			f.callbacks.SendLocalReply(http.StatusBadRequest, "", map[string]string{}, 0, "RequestBody is over limit")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().msg("RequestBody is over limit"))
+			metrics.bodyTooLarge.inc(f.directive, f.host, phaseRequestBody)
+			return f.interrupt(interruption, "RequestBody is over limit")
 		}
 	}
 	if endStream {
+		if status, interrupted := f.writeDecodedRequestBody(); interrupted {
+			return status
+		}
 		f.processRequestBody = true
 		interruption, err := tx.ProcessRequestBody()
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Failed to process request body"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("Failed to process request body"))
+			status, _ := f.onError("ProcessRequestBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessRequestBody failed"))
-			f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "ProcessRequestBody failed")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().msg("ProcessRequestBody failed"))
+			return f.interrupt(interruption, "ProcessRequestBody failed")
 		}
+		f.setMetadata()
+		return api.Continue
+	}
+	if f.conf.streamRequestBody[f.directive] {
 		return api.Continue
 	}
 	return api.StopAndBuffer
@@ -159,9 +275,15 @@ func (f *filter) DecodeTrailers(trailerMap api.RequestTrailerMap) api.StatusType
 	return api.Continue
 }
 
-func (f filter) EncodeHeaders(headerMap api.ResponseHeaderMap, endStream bool) api.StatusType {
+func (f *filter) EncodeHeaders(headerMap api.ResponseHeaderMap, endStream bool) api.StatusType {
+	return f.inspect(func() api.StatusType {
+		return f.encodeHeaders(headerMap, endStream)
+	})
+}
+
+func (f *filter) encodeHeaders(headerMap api.ResponseHeaderMap, endStream bool) api.StatusType {
 	if f.isInterruption {
-		f.callbacks.Log(api.Debug, BuildLoggerMessage().msg("Interruption already handled, sending downstream the local response"))
+		f.logStream(api.Debug, f.log().msg("Interruption already handled, sending downstream the local response"))
 		return api.Continue
 	}
 	if f.tx == nil {
@@ -171,40 +293,54 @@ func (f filter) EncodeHeaders(headerMap api.ResponseHeaderMap, endStream bool) a
 	if tx.IsRuleEngineOff() {
 		return api.Continue
 	}
+	defer f.observePhase(phaseResponseHeaders, time.Now())
 	if !f.processRequestBody {
-		f.callbacks.Log(api.Debug, BuildLoggerMessage().msg("ProcessRequestBodyInPause3"))
+		f.logStream(api.Debug, f.log().msg("ProcessRequestBodyInPause3"))
+		if status, interrupted := f.writeDecodedRequestBody(); interrupted {
+			return status
+		}
 		f.processRequestBody = true
 		interruption, err := tx.ProcessRequestBody()
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Failed to process request body"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("Failed to process request body"))
+			status, _ := f.onError("ProcessRequestBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessRequestBody failed"))
-			f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "ProcessRequestBody failed")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().msg("ProcessRequestBody failed"))
+			return f.interrupt(interruption, "ProcessRequestBody failed")
 		}
 	}
+	contentType, _ := headerMap.Get("content-type")
+	f.skipResponseBody = !f.conf.responseBodyContentTypes[f.directive].match(contentType)
+	if contentEncoding, ok := headerMap.Get("content-encoding"); ok && !f.skipResponseBody {
+		f.responseBodyDecoder = newBodyDecoder(contentEncoding, f.conf.maxDecompressedBodySize)
+	}
 	code, b := f.callbacks.StreamInfo().ResponseCode()
 	if !b {
 		code = 0
 	}
+	f.shadow.processResponseHeaders(headerMap, int(code), f.httpProtocol)
 	headerMap.Range(func(key, value string) bool {
 		tx.AddResponseHeader(key, value)
 		return true
 	})
 	interruption := tx.ProcessResponseHeaders(int(code), f.httpProtocol)
 	if interruption != nil {
-		f.isInterruption = true
-		f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessResponseHeader failed"))
-		f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Reject because of bad response header")
-		return api.LocalReply
+		f.logStream(api.Info, f.log().msg("ProcessResponseHeader failed"))
+		return f.interrupt(interruption, "Reject because of bad response header")
 	}
+	f.setMetadata()
 	return api.Continue
 }
 
 func (f *filter) EncodeData(buffer api.BufferInstance, endStream bool) api.StatusType {
+	return f.inspect(func() api.StatusType {
+		return f.encodeData(buffer, endStream)
+	})
+}
+
+func (f *filter) encodeData(buffer api.BufferInstance, endStream bool) api.StatusType {
 	if f.isInterruption {
 		f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Interruption already handled")
 		return api.LocalReply
@@ -217,52 +353,69 @@ func (f *filter) EncodeData(buffer api.BufferInstance, endStream bool) api.Statu
 	if tx.IsRuleEngineOff() {
 		return api.Continue
 	}
-	if !tx.IsResponseBodyAccessible() {
-		f.callbacks.Log(api.Debug, BuildLoggerMessage().msg("Skipping response body inspection, SecResponseBodyAccess is off"))
+	defer f.observePhase(phaseResponseBody, time.Now())
+	if !tx.IsResponseBodyAccessible() || f.skipResponseBody {
+		f.logStream(api.Debug, f.log().bool("content_type_inspected", !f.skipResponseBody).msg("Skipping response body inspection, SecResponseBodyAccess is off or the content type is not inspected"))
+		f.shadow.processResponseBody()
 		if !f.processResponseBody {
 			interruption, err := tx.ProcessResponseBody()
 			if err != nil {
-				f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("ProcessResponseBody error"))
-				return api.Continue
+				f.logStream(api.Info, f.log().err(err).msg("ProcessResponseBody error"))
+				status, _ := f.onError("ProcessResponseBody")
+				return status
 			}
 			f.processResponseBody = true
 			if interruption != nil {
-				f.isInterruption = true
-				f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ProcessResponseBody forbidden"))
-				f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "ProcessResponseBody forbidden")
-				return api.LocalReply
+				f.logStream(api.Info, f.log().msg("ProcessResponseBody forbidden"))
+				return f.interrupt(interruption, "ProcessResponseBody forbidden")
 			}
 		}
+		return api.Continue
 	}
-	if bodySize > 0 {
+	if f.responseBodyDecoder == nil {
+		f.shadow.writeResponseBody(buffer.Bytes(), endStream)
+	}
+	if bodySize > 0 && f.responseBodyDecoder != nil {
+		f.responseBodyDecoder.write(buffer.Bytes())
+	} else if bodySize > 0 {
 		ResponseBodyBuffer := buffer.Bytes()
 		interruption, _, err := tx.WriteResponseBody(ResponseBodyBuffer)
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Failed to write response body"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("Failed to write response body"))
+			status, _ := f.onError("WriteResponseBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.callbacks.Log(api.Info, BuildLoggerMessage().msg("ResponseBody is over limit"))
-			f.callbacks.SendLocalReply(http.StatusBadRequest, "", map[string]string{}, 0, "ResponseBody is over limit")
-			return api.LocalReply
+			f.logStream(api.Info, f.log().msg("ResponseBody is over limit"))
+			metrics.bodyTooLarge.inc(f.directive, f.host, phaseResponseBody)
+			return f.interrupt(interruption, "ResponseBody is over limit")
 		}
 	}
 	if endStream {
+		// the spans to mask are found in the decompressed body, a compressed body is blocked
+		compressed := f.responseBodyDecoder != nil
+		if status, interrupted := f.writeDecodedResponseBody(); interrupted {
+			return status
+		}
 		f.processResponseBody = true
 		interruption, err := tx.ProcessResponseBody()
 		if err != nil {
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("ProcessResponseBody error"))
-			return api.Continue
+			f.logStream(api.Info, f.log().err(err).msg("ProcessResponseBody error"))
+			status, _ := f.onError("ProcessResponseBody")
+			return status
 		}
 		if interruption != nil {
-			f.isInterruption = true
-			f.processResponseBody = true
+			f.logStream(api.Info, f.log().err(err).msg("ProcessResponseBody failed"))
+			if !f.enforcing() {
+				return api.Continue
+			}
+			if !compressed && f.mask(buffer, interruption) {
+				return api.Continue
+			}
 			buffer.Set(bytes.Repeat([]byte("\x00"), bodySize))
-			f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("ProcessResponseBody failed"))
-			f.callbacks.SendLocalReply(http.StatusForbidden, "", map[string]string{}, 0, "Reject because of bad response body")
-			return api.LocalReply
+			return f.interrupt(interruption, "Reject because of bad response body")
 		}
+		f.setMetadata()
 		return api.Continue
 	}
 	return api.StopAndBuffer
@@ -272,26 +425,157 @@ func (f *filter) EncodeTrailers(trailerMap api.ResponseTrailerMap) api.StatusTyp
 	return api.Continue
 }
 
+// OnLog is left empty, the dynamic metadata read by the access logs is set while processing the stream, see setMetadata
 func (f *filter) OnLog() {
 }
 
 func (f *filter) OnDestroy(reason api.DestroyReason) {
+	f.destroyed.Store(true)
+	if f.conf.inspectionPool != nil {
+		go func() {
+			f.inspecting.Wait()
+			f.closeTransaction()
+		}()
+		return
+	}
+	f.closeTransaction()
+}
+
+// closeTransaction finishes the transaction once the stream is destroyed, the stream callbacks are no longer usable
+func (f *filter) closeTransaction() {
 	tx := f.tx
 	if tx != nil {
-		if !f.processResponseBody {
-			f.callbacks.Log(api.Debug, BuildLoggerMessage().msg("Running ProcessResponseBody in OnHttpStreamDone, triggered actions will not be enforced. Further logs are for detection only purposes"))
+		defer f.recoverClose()
+		if !f.processResponseBody && !f.budgetExceeded && !f.panicked {
+			logAt(api.Debug, f.log().msg("Running ProcessResponseBody in OnHttpStreamDone, triggered actions will not be enforced. Further logs are for detection only purposes"))
 			f.processResponseBody = true
+			if f.responseBodyDecoder != nil {
+				// the interruption of the body limit can no longer be enforced, as the one of ProcessResponseBody
+				body, err := f.decodeBody(f.responseBodyDecoder)
+				if err != nil {
+					f.processingError("Decompress")
+				}
+				_, _, _ = tx.WriteResponseBody(body)
+				f.responseBodyDecoder = nil
+			}
 			_, err := tx.ProcessResponseBody()
 			if err != nil {
-				f.callbacks.Log(api.Info, BuildLoggerMessage().err(err).msg("Process response body onDestroy error"))
+				logAt(api.Info, f.log().err(err).msg("Process response body onDestroy error"))
+				f.processingError("ProcessResponseBody")
 			}
 		}
+		f.persistCollections()
+		f.shadow.close(tx, f.directive)
+		for _, id := range matchedRuleIDs(tx) {
+			metrics.rulesMatched.inc(f.directive, strconv.Itoa(id))
+		}
 		f.tx.ProcessLogging()
 		_ = f.tx.Close()
-		f.callbacks.Log(api.Info, BuildLoggerMessage().msg("Finished"))
+		logAt(api.Info, f.log().msg("Finished"))
 	}
 }
 
-func main() {
+// validTransactionID reports whether the id is a token of at most maxTransactionIDLength characters
+func validTransactionID(id string) bool {
+	if len(id) == 0 || len(id) > maxTransactionIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// enforcing reports whether interruptions are turned into local replies,
+// with rule_engine DetectionOnly they are only logged
+func (f *filter) enforcing() bool {
+	return f.conf.ruleEngine != types.RuleEngineDetectionOnly
+}
 
+// interrupt turns the Coraza interruption into a local reply, honoring the
+// status, redirect and drop actions of the rule that caused it
+func (f *filter) interrupt(interruption *types.Interruption, details string) api.StatusType {
+	if !f.enforcing() {
+		f.logStream(api.Info, f.log().str("details", details).msg("Interruption not enforced, rule engine is DetectionOnly"))
+		metrics.interruptions.inc(f.directive, f.host, f.interruptedPhase(), "detect", strconv.Itoa(interruption.Status))
+		f.setMetadata()
+		return api.Continue
+	}
+	f.isInterruption = true
+	status := interruption.Status
+	headers := map[string]string{}
+	blockResponse := f.conf.blockResponses[f.directive]
+	if blockResponse != nil && blockResponse.status != 0 && interruption.Action != "redirect" {
+		status = blockResponse.status
+	}
+	switch interruption.Action {
+	case "redirect":
+		if status < http.StatusMultipleChoices || status >= http.StatusBadRequest {
+			status = http.StatusFound
+		}
+		headers["Location"] = interruption.Data
+	case "drop":
+		// the Go filter API can neither reset the stream nor close the downstream connection,
+		// Envoy strips a "Connection: close" header set by a filter, so drop is enforced as deny
+		f.logStream(api.Debug, f.log().msg("Drop is not supported by the Go filter, enforcing it as deny"))
+	}
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if f.conf.setTransactionIDHeader {
+		headers[f.conf.transactionIDHeader] = f.tx.ID()
+	}
+	var body string
+	if blockResponse != nil {
+		for key, value := range blockResponse.headers {
+			headers[key] = value
+		}
+		var contentType string
+		var err error
+		body, contentType, err = blockResponse.render(f.accept, newBlockResponseData(f.tx.ID(), matchedRuleIDs(f.tx), status))
+		if err != nil {
+			f.logStream(api.Error, f.log().err(err).msg("Failed to render block response"))
+		} else if len(body) != 0 {
+			headers["content-type"] = contentType
+		}
+	}
+	f.logStream(api.Info, f.log().str("action", interruption.Action).int("status", status).int("rule", interruption.RuleID).msg("Interruption enforced"))
+	metrics.interruptions.inc(f.directive, f.host, f.interruptedPhase(), interruption.Action, strconv.Itoa(status))
+	f.setMetadata()
+	f.callbacks.SendLocalReply(status, body, headers, 0, details)
+	return api.LocalReply
+}
+
+// logStream logs through the callbacks of the stream, which prefix the name of the plugin, until the stream is
+// destroyed, then through the logger of the Envoy process
+func (f *filter) logStream(level api.LogType, msg string) {
+	if f.destroyed.Load() {
+		logAt(level, msg)
+		return
+	}
+	f.callbacks.Log(level, msg)
+}
+
+// log builds a log message carrying the context of the stream
+func (f *filter) log() messageTemplate {
+	m := BuildLoggerMessage()
+	if f.tx != nil {
+		m.str("transaction_id", f.tx.ID())
+	}
+	if len(f.host) != 0 {
+		m.str("host", f.host)
+	}
+	if len(f.clientIP) != 0 {
+		m.str("client_ip", f.clientIP)
+	}
+	if len(f.directive) != 0 {
+		m.str("directive", f.directive)
+	}
+	return m
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCallbacks records what the filter gives to the callbacks of the stream
+type testCallbacks struct {
+	api.FilterCallbackHandler
+	mu       sync.Mutex
+	metadata map[string]interface{}
+	logs     []string
+	replies  []int
+	headers  []map[string]string
+	details  []string
+	statuses []api.StatusType
+}
+
+func newTestCallbacks() *testCallbacks {
+	return &testCallbacks{metadata: make(map[string]interface{})}
+}
+
+func (c *testCallbacks) StreamInfo() api.StreamInfo {
+	return testStreamInfo{callbacks: c}
+}
+
+func (c *testCallbacks) Log(level api.LogType, msg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs = append(c.logs, msg)
+}
+
+func (c *testCallbacks) SendLocalReply(responseCode int, bodyText string, headers map[string]string, grpcStatus int64, details string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies = append(c.replies, responseCode)
+	c.headers = append(c.headers, headers)
+	c.details = append(c.details, details)
+}
+
+func (c *testCallbacks) Continue(status api.StatusType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.statuses = append(c.statuses, status)
+}
+
+func (c *testCallbacks) RecoverPanic() {
+	if r := recover(); r != nil {
+		c.SendLocalReply(500, "", nil, 0, "go_filter_panic")
+	}
+}
+
+type testStreamInfo struct {
+	api.StreamInfo
+	callbacks *testCallbacks
+}
+
+func (i testStreamInfo) DynamicMetadata() api.DynamicMetadata {
+	return testDynamicMetadata{callbacks: i.callbacks}
+}
+
+func (i testStreamInfo) DownstreamRemoteAddress() string {
+	return "198.51.100.1:4321"
+}
+
+// testDynamicMetadata holds the metadata of the plugin namespace by key
+type testDynamicMetadata struct {
+	callbacks *testCallbacks
+}
+
+func (m testDynamicMetadata) Get(filterName string) map[string]interface{} {
+	return nil
+}
+
+func (m testDynamicMetadata) Set(filterName string, key string, value interface{}) {
+	if filterName != pluginName {
+		return
+	}
+	m.callbacks.mu.Lock()
+	defer m.callbacks.mu.Unlock()
+	m.callbacks.metadata[key] = value
+}
+
+// newTestTransaction processes the request headers of a transaction of the directives
+func newTestTransaction(t *testing.T, directives string) types.Transaction {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(directives))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := waf.NewTransactionWithID("test")
+	tx.ProcessURI("/?q=attack", "GET", "HTTP/1.1")
+	tx.ProcessRequestHeaders()
+	t.Cleanup(func() {
+		_ = tx.Close()
+	})
+	return tx
+}
+
+func TestValidTransactionID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"f47ac10b-58cc-4372-a567-0e02b2c3d479", true},
+		{"abc_123.x~y", true},
+		{strings.Repeat("a", maxTransactionIDLength), true},
+		{"", false},
+		{strings.Repeat("a", maxTransactionIDLength+1), false},
+		{"id with spaces", false},
+		{"id\nforged log line", false},
+		{`"id"`, false},
+		{"<script>", false},
+		{"idé", false},
+	}
+	for _, test := range tests {
+		if got := validTransactionID(test.id); got != test.want {
+			t.Errorf("validTransactionID(%q) = %v, want %v", test.id, got, test.want)
+		}
+	}
+}
+
+// testBuffer is a body chunk
+type testBuffer struct {
+	api.BufferInstance
+	data []byte
+}
+
+func (b testBuffer) Bytes() []byte {
+	return b.data
+}
+
+func (b testBuffer) Len() int {
+	return len(b.data)
+}
+
+func TestDecodeDataStream(t *testing.T) {
+	const directives = `SecRuleEngine On
+SecRequestBodyAccess On
+SecRequestBodyLimit 16
+SecRequestBodyLimitAction Reject
+SecAction "id:2,phase:1,pass,nolog,ctl:forceRequestBodyVariable=On"
+SecRule REQUEST_BODY "@contains attack" "id:1,phase:2,deny,status:403"`
+	tests := []struct {
+		name    string
+		stream  bool
+		chunks  []string
+		want    []api.StatusType
+		replies []int
+	}{
+		{"buffer", false, []string{"hello ", "you"}, []api.StatusType{api.StopAndBuffer, api.Continue}, nil},
+		{"buffer attack", false, []string{"an ", "attack"}, []api.StatusType{api.StopAndBuffer, api.LocalReply}, []int{403}},
+		// the chunks are forwarded as they are written, the last one is held for ProcessRequestBody
+		{"stream", true, []string{"hello ", "you"}, []api.StatusType{api.Continue, api.Continue}, nil},
+		{"stream attack", true, []string{"an ", "attack"}, []api.StatusType{api.Continue, api.LocalReply}, []int{403}},
+		// the rules see the whole body, not the chunks
+		{"stream split attack", true, []string{"att", "ack"}, []api.StatusType{api.Continue, api.LocalReply}, []int{403}},
+		{"stream empty last chunk", true, []string{"attack", ""}, []api.StatusType{api.Continue, api.LocalReply}, []int{403}},
+		// the body limit interrupts the chunk going over it, the chunks before it are already forwarded
+		{"stream over limit", true, []string{"hello ", "world", "and more"}, []api.StatusType{api.Continue, api.Continue, api.LocalReply}, []int{413}},
+		// the chunks after the interruption are rejected
+		{"stream after interruption", true, []string{"hello world and more", "attack"}, []api.StatusType{api.LocalReply, api.LocalReply}, []int{413, 403}},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{
+			callbacks: callbacks,
+			conf:      configuration{streamRequestBody: map[string]bool{"waf1": test.stream}},
+			directive: "waf1",
+			tx:        newTestTransaction(t, directives),
+		}
+		var got []api.StatusType
+		for i, chunk := range test.chunks {
+			got = append(got, f.decodeData(testBuffer{data: []byte(chunk)}, i == len(test.chunks)-1))
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(callbacks.replies, test.replies) {
+			t.Errorf("%s: decodeData = %v, replies %v, want %v, %v", test.name, got, callbacks.replies, test.want, test.replies)
+		}
+	}
+}
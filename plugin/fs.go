@@ -4,9 +4,13 @@ import (
 	"embed"
 	"fmt"
 	"io/fs"
+	"os"
 	"strings"
 )
 
+// rulesDirAlias prefixes the paths of the files of the rules_dir directory
+const rulesDirAlias = "@rules_dir"
+
 var (
 	//go:embed rules
 	crs  embed.FS
@@ -27,6 +31,7 @@ func init() {
 		map[string]string{
 			"@owasp_crs": "crs",
 		},
+		nil,
 	}
 }
 
@@ -34,13 +39,28 @@ type rulesFS struct {
 	fs           fs.FS
 	filesMapping map[string]string
 	dirsMapping  map[string]string
+	// local resolves the @rules_dir paths, it is nil when no rules_dir is configured
+	local fs.FS
+}
+
+// withRulesDir returns a copy of the embedded rules FS resolving the @rules_dir paths to the local directory
+func withRulesDir(dir string) fs.FS {
+	r := *root.(*rulesFS)
+	r.local = os.DirFS(dir)
+	return &r
 }
 
 func (r rulesFS) Open(name string) (fs.File, error) {
+	if local, ok := r.localPath(name); ok {
+		return r.local.Open(local)
+	}
 	return r.fs.Open(r.mapPath(name))
 }
 
 func (r rulesFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if local, ok := r.localPath(name); ok {
+		return fs.ReadDir(r.local, local)
+	}
 	for a, dst := range r.dirsMapping {
 		if a == name {
 			return fs.ReadDir(r.fs, dst)
@@ -55,9 +75,26 @@ func (r rulesFS) ReadDir(name string) ([]fs.DirEntry, error) {
 }
 
 func (r rulesFS) ReadFile(name string) ([]byte, error) {
+	if local, ok := r.localPath(name); ok {
+		return fs.ReadFile(r.local, local)
+	}
 	return fs.ReadFile(r.fs, r.mapPath(name))
 }
 
+func (r rulesFS) localPath(p string) (string, bool) {
+	if r.local == nil {
+		return "", false
+	}
+	if p == rulesDirAlias {
+		return ".", true
+	}
+	prefix := rulesDirAlias + "/"
+	if strings.HasPrefix(p, prefix) {
+		return p[len(prefix):], true
+	}
+	return "", false
+}
+
 func (r rulesFS) mapPath(p string) string {
 	if strings.IndexByte(p, '/') != -1 {
 		// is not in root, hence we can do dir mapping
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// geoDatabaseKey is the TX variable binding the transaction to the GeoIP database, @geoLookup matches nothing without it
+const geoDatabaseKey = "waf_go_envoy_geo_database"
+
+func init() {
+	plugins.RegisterOperator("geoLookup", func(plugintypes.OperatorOptions) (plugintypes.Operator, error) {
+		return &geoLookup{}, nil
+	})
+}
+
+// geoDatabase is a MaxMind DB, e.g. GeoLite2-Country.mmdb, loaded from geoip_database
+type geoDatabase struct {
+	path    string
+	size    int64
+	modTime time.Time
+	reader  *maxminddb.Reader
+}
+
+// geoDatabases holds the databases by path, a database is loaded again when a config is parsed after its file changed
+var geoDatabases = struct {
+	sync.Mutex
+	databases map[string]*geoDatabase
+}{databases: make(map[string]*geoDatabase)}
+
+func loadGeoDatabase(path string) (*geoDatabase, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("geoip_database %s error:%s", path, err.Error()))
+	}
+	geoDatabases.Lock()
+	defer geoDatabases.Unlock()
+	if db, ok := geoDatabases.databases[path]; ok && db.size == info.Size() && db.modTime.Equal(info.ModTime()) {
+		return db, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("geoip_database %s error:%s", path, err.Error()))
+	}
+	reader, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("geoip_database %s error:%s", path, err.Error()))
+	}
+	db := &geoDatabase{path: path, size: info.Size(), modTime: info.ModTime(), reader: reader}
+	geoDatabases.databases[path] = db
+	return db, nil
+}
+
+func lookupGeoDatabase(path string) (*geoDatabase, bool) {
+	geoDatabases.Lock()
+	defer geoDatabases.Unlock()
+	db, ok := geoDatabases.databases[path]
+	return db, ok
+}
+
+// lookup returns the GEO variables of the address, nil when the database has no record of it
+func (db *geoDatabase) lookup(ip string) map[string]string {
+	if db == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	// an IPv6 address has no record in an IPv4 database, the library reports it as an error
+	var record interface{}
+	if err := db.reader.Lookup(net.IP(addr.AsSlice()), &record); err != nil || record == nil {
+		return nil
+	}
+	return geoVariables(record)
+}
+
+// geoVariables maps a GeoIP2 country or city record to the GEO variables of ModSecurity
+func geoVariables(record interface{}) map[string]string {
+	values := make(map[string]string)
+	country := mmdbPath(record, "country")
+	if country == nil {
+		country = mmdbPath(record, "registered_country")
+	}
+	setGeoString(values, "COUNTRY_CODE", mmdbPath(country, "iso_code"))
+	setGeoString(values, "COUNTRY_NAME", mmdbPath(country, "names", "en"))
+	setGeoString(values, "COUNTRY_CONTINENT", mmdbPath(record, "continent", "code"))
+	setGeoString(values, "CITY", mmdbPath(record, "city", "names", "en"))
+	setGeoString(values, "POSTAL_CODE", mmdbPath(record, "postal", "code"))
+	if subdivisions, ok := mmdbPath(record, "subdivisions").([]interface{}); ok && len(subdivisions) != 0 {
+		setGeoString(values, "REGION", mmdbPath(subdivisions[0], "iso_code"))
+	}
+	if latitude, ok := mmdbPath(record, "location", "latitude").(float64); ok {
+		values["LATITUDE"] = strconv.FormatFloat(latitude, 'f', -1, 64)
+	}
+	if longitude, ok := mmdbPath(record, "location", "longitude").(float64); ok {
+		values["LONGITUDE"] = strconv.FormatFloat(longitude, 'f', -1, 64)
+	}
+	return values
+}
+
+func mmdbPath(value interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+	return value
+}
+
+func setGeoString(values map[string]string, key string, value interface{}) {
+	if s, ok := value.(string); ok && len(s) != 0 {
+		values[key] = s
+	}
+}
+
+// setGeo binds the transaction to the GeoIP database and sets the GEO variables of the client address
+func (f *filter) setGeo(tx types.Transaction, values map[string]string) {
+	state, ok := tx.(plugintypes.TransactionState)
+	if !ok || f.conf.geoDatabase == nil {
+		return
+	}
+	state.Variables().TX().Set(geoDatabaseKey, []string{f.conf.geoDatabase.path})
+	for key, value := range values {
+		state.Variables().Geo().Set(key, []string{value})
+	}
+}
+
+// geoLookup looks up the address of its argument and sets the GEO variables, it matches when the database has a
+// record of the address:
+//
+//	SecRule REMOTE_ADDR "@geoLookup" "id:1000,phase:1,nolog,pass,chain"
+//	  SecRule GEO:COUNTRY_CODE "!@pm FR DE" "deny,status:403"
+type geoLookup struct{}
+
+func (o *geoLookup) Evaluate(tx plugintypes.TransactionState, value string) bool {
+	path := tx.Variables().TX().Get(geoDatabaseKey)
+	if len(path) == 0 {
+		return false
+	}
+	db, ok := lookupGeoDatabase(path[0])
+	if !ok {
+		return false
+	}
+	values := db.lookup(value)
+	if values == nil {
+		return false
+	}
+	geo := tx.Variables().Geo()
+	for _, key := range []string{"COUNTRY_CODE", "COUNTRY_NAME", "COUNTRY_CONTINENT", "CITY", "POSTAL_CODE", "REGION", "LATITUDE", "LONGITUDE"} {
+		geo.Remove(key)
+	}
+	for key, value := range values {
+		geo.Set(key, []string{value})
+	}
+	return true
+}
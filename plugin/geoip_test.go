@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file,
+// see https://maxmind.github.io/MaxMind-DB/
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSectionSeparator = 16
+
+// the types of the data section values
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+)
+
+// mmdbTestPointer is encoded as a pointer to the offset of the data section
+type mmdbTestPointer uint
+
+// mmdbEncoder encodes the values of a data section
+type mmdbEncoder struct {
+	b []byte
+}
+
+func (e *mmdbEncoder) ctrl(typ, size int) {
+	var extra []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extra = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		extra = binary.BigEndian.AppendUint16(nil, uint16(size-285))
+		size = 30
+	default:
+		extra = binary.BigEndian.AppendUint32(nil, uint32(size-65821))[1:]
+		size = 31
+	}
+	if typ > 7 {
+		e.b = append(e.b, byte(size), byte(typ-7))
+	} else {
+		e.b = append(e.b, byte(typ<<5|size))
+	}
+	e.b = append(e.b, extra...)
+}
+
+// encode appends the value and returns its offset
+func (e *mmdbEncoder) encode(value interface{}) uint {
+	offset := uint(len(e.b))
+	switch v := value.(type) {
+	case string:
+		e.ctrl(mmdbString, len(v))
+		e.b = append(e.b, v...)
+	case []byte:
+		e.ctrl(mmdbBytes, len(v))
+		e.b = append(e.b, v...)
+	case uint64:
+		n := binary.BigEndian.AppendUint64(nil, v)
+		for len(n) != 0 && n[0] == 0 {
+			n = n[1:]
+		}
+		typ := mmdbUint32
+		if len(n) > 4 {
+			typ = mmdbUint64
+		}
+		e.ctrl(typ, len(n))
+		e.b = append(e.b, n...)
+	case float64:
+		e.ctrl(mmdbDouble, 8)
+		e.b = binary.BigEndian.AppendUint64(e.b, math.Float64bits(v))
+	case map[string]interface{}:
+		e.ctrl(mmdbMap, len(v))
+		for _, key := range sortedKeys(v) {
+			e.encode(key)
+			e.encode(v[key])
+		}
+	case []interface{}:
+		e.ctrl(mmdbArray, len(v))
+		for _, child := range v {
+			e.encode(child)
+		}
+	case mmdbTestPointer:
+		p := uint32(v)
+		switch {
+		case p < 2048:
+			e.b = append(e.b, byte(mmdbPointer<<5|p>>8), byte(p))
+		case p < 526336:
+			p -= 2048
+			e.b = append(e.b, byte(mmdbPointer<<5|1<<3|p>>16), byte(p>>8), byte(p))
+		case p < 134744064:
+			p -= 526336
+			e.b = append(e.b, byte(mmdbPointer<<5|2<<3|p>>24), byte(p>>16), byte(p>>8), byte(p))
+		default:
+			e.b = binary.BigEndian.AppendUint32(append(e.b, mmdbPointer<<5|3<<3), p)
+		}
+	default:
+		panic("unsupported value")
+	}
+	return offset
+}
+
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	// records are the data offsets of the leaves, plus one, zero is no record
+	records [2]uint
+}
+
+// buildMMDB returns a MaxMind DB mapping the prefixes to the offsets of the data section
+func buildMMDB(recordSize, ipVersion int, prefixes map[string]uint, data []byte) []byte {
+	root := &mmdbTestNode{}
+	for _, s := range sortedKeys(prefixes) {
+		prefix := netip.MustParsePrefix(s)
+		var b []byte
+		bits := prefix.Bits()
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			// the IPv4 addresses are in ::/96
+			b = append(make([]byte, 12), prefix.Addr().AsSlice()...)
+			bits += 96
+		} else {
+			b = prefix.Addr().AsSlice()
+		}
+		node := root
+		for i := 0; i < bits-1; i++ {
+			bit := b[i/8] >> (7 - i%8) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{}
+			}
+			node = node.children[bit]
+		}
+		node.records[b[(bits-1)/8]>>(7-(bits-1)%8)&1] = prefixes[s] + 1
+	}
+	var nodes []*mmdbTestNode
+	numbers := make(map[*mmdbTestNode]uint)
+	for queue := []*mmdbTestNode{root}; len(queue) != 0; queue = queue[1:] {
+		numbers[queue[0]] = uint(len(nodes))
+		nodes = append(nodes, queue[0])
+		for _, child := range queue[0].children {
+			if child != nil {
+				queue = append(queue, child)
+			}
+		}
+	}
+	nodeCount := uint(len(nodes))
+	var tree []byte
+	for _, node := range nodes {
+		var records [2]uint
+		for bit := range records {
+			switch {
+			case node.children[bit] != nil:
+				records[bit] = numbers[node.children[bit]]
+			case node.records[bit] != 0:
+				records[bit] = nodeCount + mmdbDataSectionSeparator + node.records[bit] - 1
+			default:
+				records[bit] = nodeCount
+			}
+		}
+		switch recordSize {
+		case 24:
+			for _, r := range records {
+				tree = append(tree, byte(r>>16), byte(r>>8), byte(r))
+			}
+		case 28:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[0]>>20&0xf0|records[1]>>24&0x0f), byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		default:
+			for _, r := range records {
+				tree = binary.BigEndian.AppendUint32(tree, uint32(r))
+			}
+		}
+	}
+	metadata := &mmdbEncoder{}
+	metadata.encode(map[string]interface{}{
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"build_epoch":                 uint64(0),
+		"database_type":               "Test",
+		"description":                 map[string]interface{}{"en": "Test"},
+		"languages":                   []interface{}{"en"},
+		"node_count":                  uint64(nodeCount),
+		"record_size":                 uint64(recordSize),
+		"ip_version":                  uint64(ipVersion),
+	})
+	b := append(tree, make([]byte, mmdbDataSectionSeparator)...)
+	b = append(b, data...)
+	b = append(b, mmdbMetadataMarker...)
+	return append(b, metadata.b...)
+}
+
+// testGeoRecords returns the data section of the test databases, the country names are shared through a pointer
+func testGeoRecords() ([]byte, uint, uint) {
+	e := &mmdbEncoder{}
+	names := e.encode(map[string]interface{}{"en": "France"})
+	france := e.encode(map[string]interface{}{
+		"continent": map[string]interface{}{"code": "EU"},
+		"country":   map[string]interface{}{"iso_code": "FR", "names": mmdbTestPointer(names)},
+		"location":  map[string]interface{}{"latitude": 48.8582, "longitude": 2.3387},
+	})
+	germany := e.encode(map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "DE"},
+		"subdivisions":       []interface{}{map[string]interface{}{"iso_code": "BE"}},
+	})
+	return e.b, france, germany
+}
+
+// writeGeoDatabase writes the database to a file of the test directory
+func writeGeoDatabase(t *testing.T, b []byte) string {
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoDatabaseLookup(t *testing.T) {
+	data, france, germany := testGeoRecords()
+	tests := []struct {
+		ip   string
+		want map[string]string
+	}{
+		{"1.2.3.4", map[string]string{"COUNTRY_CODE": "FR", "COUNTRY_NAME": "France", "COUNTRY_CONTINENT": "EU", "LATITUDE": "48.8582", "LONGITUDE": "2.3387"}},
+		{"1.2.3.255", map[string]string{"COUNTRY_CODE": "FR", "COUNTRY_NAME": "France", "COUNTRY_CONTINENT": "EU", "LATITUDE": "48.8582", "LONGITUDE": "2.3387"}},
+		// the IPv4-mapped and IPv4-compatible addresses are the IPv4 ones
+		{"::ffff:1.2.3.4", map[string]string{"COUNTRY_CODE": "FR", "COUNTRY_NAME": "France", "COUNTRY_CONTINENT": "EU", "LATITUDE": "48.8582", "LONGITUDE": "2.3387"}},
+		{"::1.2.3.4", map[string]string{"COUNTRY_CODE": "FR", "COUNTRY_NAME": "France", "COUNTRY_CONTINENT": "EU", "LATITUDE": "48.8582", "LONGITUDE": "2.3387"}},
+		{"2001:db8::1", map[string]string{"COUNTRY_CODE": "DE", "REGION": "BE"}},
+		{"2001:db8:ffff::1", map[string]string{"COUNTRY_CODE": "DE", "REGION": "BE"}},
+		{"1.2.4.1", nil},
+		{"2001:db9::1", nil},
+		{"::", nil},
+		{"not an address", nil},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		path := writeGeoDatabase(t, buildMMDB(recordSize, 6, map[string]uint{"1.2.3.0/24": france, "2001:db8::/32": germany}, data))
+		db, err := loadGeoDatabase(path)
+		if err != nil {
+			t.Fatalf("record_size %d: %s", recordSize, err.Error())
+		}
+		for _, test := range tests {
+			assertGeoVariables(t, db, test.ip, test.want)
+		}
+	}
+}
+
+func TestGeoDatabaseLookupIPv4Database(t *testing.T) {
+	data, france, _ := testGeoRecords()
+	db, err := loadGeoDatabase(writeGeoDatabase(t, buildMMDB(24, 4, map[string]uint{"1.2.3.0/24": france}, data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip string
+		ok bool
+	}{
+		{"1.2.3.4", true},
+		{"::ffff:1.2.3.4", true},
+		{"1.2.4.1", false},
+		// an IPv4 database has no IPv6 records
+		{"::1.2.3.4", false},
+		{"2001:db8::1", false},
+	}
+	for _, test := range tests {
+		if got := db.lookup(test.ip); (got != nil) != test.ok {
+			t.Errorf("lookup(%s) = %v, want a record %v", test.ip, got, test.ok)
+		}
+	}
+}
+
+func assertGeoVariables(t *testing.T, db *geoDatabase, ip string, want map[string]string) {
+	t.Helper()
+	got := db.lookup(ip)
+	if len(got) != len(want) {
+		t.Errorf("lookup(%s) = %v, want %v", ip, got, want)
+		return
+	}
+	for _, key := range sortedKeys(want) {
+		if got[key] != want[key] {
+			t.Errorf("lookup(%s) %s = %q, want %q", ip, key, got[key], want[key])
+		}
+	}
+}
+
+func TestLoadGeoDatabase(t *testing.T) {
+	data, france, _ := testGeoRecords()
+	path := writeGeoDatabase(t, buildMMDB(24, 4, map[string]uint{"1.2.3.0/24": france}, data))
+	db, err := loadGeoDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the database is loaded again once its file changed
+	if same, err := loadGeoDatabase(path); err != nil || same != db {
+		t.Errorf("unchanged database loaded again: %v", err)
+	}
+	if err := os.WriteFile(path, buildMMDB(24, 4, map[string]uint{"1.2.0.0/16": france}, data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadGeoDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.lookup("1.2.4.1") == nil {
+		t.Error("changed database not loaded again")
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"no metadata", []byte("not a database")},
+		{"truncated metadata", append(append([]byte(nil), mmdbMetadataMarker...), mmdbMap<<5|3)},
+	}
+	for _, test := range tests {
+		if _, err := loadGeoDatabase(writeGeoDatabase(t, test.b)); err == nil {
+			t.Errorf("%s: database loaded", test.name)
+		}
+	}
+	if _, err := loadGeoDatabase(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("missing database loaded")
+	}
+}
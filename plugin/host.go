@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	hostWildcardPrefix = "*."
+	hostSuffixPrefix   = "."
+	hostRegexPrefix    = "~"
+)
+
+// hostMatcher resolves the directive of a host from the host_directive_map keys.
+// Keys are matched with the following precedence:
+//  1. exact host, port included ("foo.example.com:8080")
+//  2. exact host, port excluded ("foo.example.com")
+//  3. the longest suffix, "*.example.com" matches the subdomains only while
+//     ".example.com" matches example.com as well as its subdomains
+//  4. regular expressions prefixed with "~" ("~^api[0-9]+\.example\.com$"), in key order
+type hostMatcher struct {
+	exact    map[string]string
+	suffixes []hostSuffix
+	regexps  []hostRegexp
+}
+
+type hostSuffix struct {
+	suffix    string
+	matchApex bool
+	directive string
+}
+
+type hostRegexp struct {
+	regexp    *regexp.Regexp
+	directive string
+}
+
+func newHostMatcher(hostDirectiveMap HostDirectiveMap) (*hostMatcher, error) {
+	m := &hostMatcher{exact: make(map[string]string)}
+	for _, host := range sortedKeys(hostDirectiveMap) {
+		directive := hostDirectiveMap[host]
+		switch {
+		case strings.HasPrefix(host, hostRegexPrefix):
+			re, err := regexp.Compile(host[len(hostRegexPrefix):])
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("host pattern %s is not a valid regexp: %s", host, err.Error()))
+			}
+			m.regexps = append(m.regexps, hostRegexp{regexp: re, directive: directive})
+		case strings.HasPrefix(host, hostWildcardPrefix):
+			m.suffixes = append(m.suffixes, hostSuffix{suffix: strings.ToLower(host[len(hostWildcardPrefix)-1:]), directive: directive})
+		case strings.HasPrefix(host, hostSuffixPrefix):
+			m.suffixes = append(m.suffixes, hostSuffix{suffix: strings.ToLower(host), matchApex: true, directive: directive})
+		default:
+			m.exact[strings.ToLower(host)] = directive
+		}
+	}
+	sort.SliceStable(m.suffixes, func(i, j int) bool {
+		return len(m.suffixes[i].suffix) > len(m.suffixes[j].suffix)
+	})
+	return m, nil
+}
+
+// match returns the directive mapped to the host, the host may carry a port
+func (m *hostMatcher) match(host string) (string, bool) {
+	if m == nil || len(host) == 0 {
+		return "", false
+	}
+	host = strings.ToLower(host)
+	if directive, ok := m.exact[host]; ok {
+		return directive, true
+	}
+	if server, _, err := net.SplitHostPort(host); err == nil {
+		host = server
+		if directive, ok := m.exact[host]; ok {
+			return directive, true
+		}
+	}
+	for _, s := range m.suffixes {
+		if strings.HasSuffix(host, s.suffix) || (s.matchApex && host == s.suffix[len(hostSuffixPrefix):]) {
+			return s.directive, true
+		}
+	}
+	for _, r := range m.regexps {
+		if r.regexp.MatchString(host) {
+			return r.directive, true
+		}
+	}
+	return "", false
+}
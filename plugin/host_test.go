@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestHostMatcher(t *testing.T) {
+	m, err := newHostMatcher(HostDirectiveMap{
+		"foo.example.com:8080":         "exact-port",
+		"Foo.Example.com":              "exact",
+		"*.example.com":                "wildcard",
+		"*.api.example.com":            "api-wildcard",
+		".shop.com":                    "shop",
+		"~^api[0-9]+\\.example\\.org$": "regexp",
+		"~example\\.org$":              "org",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		// the exact host with the port comes first
+		{"foo.example.com:8080", "exact-port", true},
+		{"foo.example.com:9090", "exact", true},
+		{"foo.example.com", "exact", true},
+		{"FOO.example.COM", "exact", true},
+		// the exact host comes before the suffixes
+		{"bar.example.com", "wildcard", true},
+		{"bar.example.com:8080", "wildcard", true},
+		// the longest suffix wins
+		{"v1.api.example.com", "api-wildcard", true},
+		{"api.example.com", "wildcard", true},
+		// *. matches the subdomains only, . matches the apex as well
+		{"example.com", "", false},
+		{"shop.com", "shop", true},
+		{"www.shop.com", "shop", true},
+		{"myshop.com", "", false},
+		// the regular expressions come last, in key order
+		{"api1.example.org", "regexp", true},
+		{"api1.example.org:443", "regexp", true},
+		{"www.example.org", "org", true},
+		{"example.net", "", false},
+		{"", "", false},
+		{"[2001:db8::1]:8080", "", false},
+	}
+	for _, test := range tests {
+		got, ok := m.match(test.host)
+		if got != test.want || ok != test.ok {
+			t.Errorf("match(%q) = %q, %v, want %q, %v", test.host, got, ok, test.want, test.ok)
+		}
+	}
+	var nilMatcher *hostMatcher
+	if _, ok := nilMatcher.match("foo.example.com"); ok {
+		t.Error("nil matcher matched")
+	}
+}
+
+func TestHostMatcherInvalidRegexp(t *testing.T) {
+	if _, err := newHostMatcher(HostDirectiveMap{"~(": "waf"}); err == nil {
+		t.Error("invalid host regexp accepted")
+	}
+}
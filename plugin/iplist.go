@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultIPListsPollInterval = 10 * time.Second
+
+	ipListAllow = "allow"
+	ipListBlock = "block"
+)
+
+// IPLists configures the addresses and CIDRs checked before the transaction is created: the allowed clients
+// skip the WAF, the blocked ones are rejected. The files list an address or a CIDR per line, # starts a comment.
+type IPLists struct {
+	Allow        []string `json:"allow"`
+	AllowFiles   []string `json:"allow_files"`
+	Block        []string `json:"block"`
+	BlockFiles   []string `json:"block_files"`
+	PollInterval string   `json:"poll_interval"`
+}
+
+// cidrTrie is a binary radix trie of CIDRs, an address is looked up in at most 32 or 128 steps
+// whatever the number of CIDRs
+type cidrTrie struct {
+	v4 *cidrNode
+	v6 *cidrNode
+}
+
+type cidrNode struct {
+	children [2]*cidrNode
+	// terminal is set on the node of a CIDR, the addresses below it are contained
+	terminal bool
+}
+
+func newCIDRTrie() *cidrTrie {
+	return &cidrTrie{v4: &cidrNode{}, v6: &cidrNode{}}
+}
+
+func (t *cidrTrie) insert(prefix netip.Prefix) {
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+	b := addr.AsSlice()
+	for i := 0; i < bits; i++ {
+		if node.terminal {
+			return
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &cidrNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+	// the CIDRs below are contained, drop them
+	node.children = [2]*cidrNode{}
+}
+
+func (t *cidrTrie) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+	b := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		node = node.children[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
+
+// ipLists are the compiled allow and block lists
+type ipLists struct {
+	allow *cidrTrie
+	block *cidrTrie
+}
+
+// match returns the list of the address, allow takes precedence over block
+func (l *ipLists) match(addr netip.Addr) (string, bool) {
+	if l.allow.contains(addr) {
+		return ipListAllow, true
+	}
+	if l.block.contains(addr) {
+		return ipListBlock, true
+	}
+	return "", false
+}
+
+func loadIPLists(config *IPLists) (*ipLists, error) {
+	allow, err := loadCIDRTrie(ipListAllow, config.Allow, config.AllowFiles)
+	if err != nil {
+		return nil, err
+	}
+	block, err := loadCIDRTrie(ipListBlock, config.Block, config.BlockFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &ipLists{allow: allow, block: block}, nil
+}
+
+func loadCIDRTrie(list string, entries []string, files []string) (*cidrTrie, error) {
+	trie := newCIDRTrie()
+	for _, entry := range entries {
+		prefix, err := parsePrefix(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ip_lists %s %s is not an address or a CIDR", list, entry))
+		}
+		trie.insert(prefix)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("ip_lists %s_files %s read error:%s", list, file, err.Error()))
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for line := 1; scanner.Scan(); line++ {
+			entry, _, _ := strings.Cut(scanner.Text(), "#")
+			entry = strings.TrimSpace(entry)
+			if len(entry) == 0 {
+				continue
+			}
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("ip_lists %s_files %s:%d %s is not an address or a CIDR", list, file, line, entry))
+			}
+			trie.insert(prefix)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errors.New(fmt.Sprintf("ip_lists %s_files %s read error:%s", list, file, err.Error()))
+		}
+	}
+	return trie, nil
+}
+
+// ipListsWatcher polls the files of the lists and swaps the lists when they change,
+// when a file fails to load the last good lists stay active
+type ipListsWatcher struct {
+	config      *IPLists
+	interval    time.Duration
+	lists       *atomic.Pointer[ipLists]
+	fingerprint string
+	stop        chan struct{}
+}
+
+// ipListsHandle is referenced by the configuration, the watcher goroutine is stopped
+// once the configuration, and therefore the handle, is garbage collected
+type ipListsHandle struct {
+	lists   *atomic.Pointer[ipLists]
+	watcher *ipListsWatcher
+}
+
+func newIPListsHandle(config *IPLists) (*ipListsHandle, error) {
+	interval := defaultIPListsPollInterval
+	if len(config.PollInterval) != 0 {
+		var err error
+		interval, err = time.ParseDuration(config.PollInterval)
+		if err != nil || interval <= 0 {
+			return nil, errors.New(fmt.Sprintf("ip_lists poll_interval %s is not a positive duration", config.PollInterval))
+		}
+	}
+	fingerprint := ipListFilesFingerprint(config)
+	lists, err := loadIPLists(config)
+	if err != nil {
+		return nil, err
+	}
+	handle := &ipListsHandle{lists: &atomic.Pointer[ipLists]{}}
+	handle.lists.Store(lists)
+	if len(config.AllowFiles) == 0 && len(config.BlockFiles) == 0 || lintOnly {
+		return handle, nil
+	}
+	w := &ipListsWatcher{
+		config:      config,
+		interval:    interval,
+		lists:       handle.lists,
+		fingerprint: fingerprint,
+		stop:        make(chan struct{}),
+	}
+	handle.watcher = w
+	return handle, nil
+}
+
+// start starts the watcher of the files, once the configuration is accepted
+func (h *ipListsHandle) start() {
+	if h == nil || h.watcher == nil {
+		return
+	}
+	runtime.SetFinalizer(h, func(h *ipListsHandle) {
+		close(h.watcher.stop)
+	})
+	go h.watcher.run()
+}
+
+// match returns the list of the address, a nil handle matches no address
+func (h *ipListsHandle) match(ip string) (string, bool) {
+	if h == nil {
+		return "", false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", false
+	}
+	return h.lists.Load().match(addr)
+}
+
+func (w *ipListsWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+func (w *ipListsWatcher) poll() {
+	fingerprint := ipListFilesFingerprint(w.config)
+	if fingerprint == w.fingerprint {
+		return
+	}
+	w.fingerprint = fingerprint
+	lists, err := loadIPLists(w.config)
+	if err != nil {
+		api.LogError(BuildLoggerMessage().err(err).msg("Failed to reload ip_lists, keep the current lists"))
+		return
+	}
+	w.lists.Store(lists)
+	api.LogInfo(BuildLoggerMessage().msg("ip_lists reloaded"))
+}
+
+// ipListFilesFingerprint summarizes the sizes and modification times of the files of the lists
+func ipListFilesFingerprint(config *IPLists) string {
+	var b strings.Builder
+	for _, file := range append(append([]string{}, config.AllowFiles...), config.BlockFiles...) {
+		b.WriteString(file)
+		b.WriteByte('|')
+		if info, err := os.Stat(file); err == nil {
+			b.WriteString(strconv.FormatInt(info.Size(), 10))
+			b.WriteByte('|')
+			b.WriteString(strconv.FormatInt(info.ModTime().UnixNano(), 10))
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
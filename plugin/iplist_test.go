@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCIDRTrie(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefixes []string
+		contains []string
+		excludes []string
+	}{
+		{"IPv4 address", []string{"192.0.2.1"}, []string{"192.0.2.1", "::ffff:192.0.2.1"}, []string{"192.0.2.2", "192.0.2.0", "::192.0.2.1"}},
+		{"IPv4 /32", []string{"192.0.2.1/32"}, []string{"192.0.2.1"}, []string{"192.0.2.0"}},
+		{"IPv4 CIDR", []string{"10.0.0.0/8"}, []string{"10.0.0.0", "10.255.255.255", "::ffff:10.1.2.3"}, []string{"11.0.0.0", "9.255.255.255", "2001:db8::1"}},
+		{"unmasked CIDR", []string{"10.1.2.3/8"}, []string{"10.200.0.1"}, []string{"11.0.0.0"}},
+		{"IPv4 /0", []string{"0.0.0.0/0"}, []string{"0.0.0.0", "255.255.255.255", "::ffff:1.2.3.4"}, []string{"::1", "2001:db8::1"}},
+		{"IPv6 address", []string{"2001:db8::1"}, []string{"2001:db8::1"}, []string{"2001:db8::2"}},
+		{"IPv6 /128", []string{"2001:db8::1/128"}, []string{"2001:db8::1"}, []string{"2001:db8::"}},
+		{"IPv6 CIDR", []string{"2001:db8::/32"}, []string{"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"}, []string{"2001:db9::", "10.0.0.1"}},
+		// the IPv4 addresses are looked up as IPv4 whatever their form, ::/0 holds the IPv6 ones
+		{"IPv6 /0", []string{"::/0"}, []string{"::", "2001:db8::1", "::1.2.3.4"}, []string{"1.2.3.4", "::ffff:1.2.3.4"}},
+		{"IPv4-mapped CIDR", []string{"::ffff:10.0.0.0/104"}, []string{"10.1.2.3", "::ffff:10.1.2.3"}, []string{"11.0.0.0"}},
+		{"IPv4-mapped address", []string{"::ffff:192.0.2.1"}, []string{"192.0.2.1"}, []string{"192.0.2.2"}},
+		// the IPv4-mapped CIDRs shorter than /96 hold IPv6 addresses
+		{"IPv4-mapped /80", []string{"::ffff:0.0.0.0/80"}, []string{"::1"}, []string{"10.0.0.1"}},
+		// a CIDR contains the longer ones, whatever the insertion order
+		{"longer CIDR first", []string{"10.1.0.0/16", "10.0.0.0/8"}, []string{"10.1.2.3", "10.2.0.0"}, []string{"11.0.0.0"}},
+		{"shorter CIDR first", []string{"10.0.0.0/8", "10.1.0.0/16"}, []string{"10.1.2.3", "10.2.0.0"}, []string{"11.0.0.0"}},
+		{"siblings", []string{"10.1.0.0/16", "10.2.0.0/16"}, []string{"10.1.2.3", "10.2.2.3"}, []string{"10.0.0.1", "10.3.0.0"}},
+		{"empty", nil, nil, []string{"10.0.0.1", "::1"}},
+	}
+	for _, test := range tests {
+		trie := newCIDRTrie()
+		for _, s := range test.prefixes {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err.Error())
+			}
+			trie.insert(prefix)
+		}
+		for _, ip := range test.contains {
+			if !trie.contains(netip.MustParseAddr(ip)) {
+				t.Errorf("%s: %s is not contained", test.name, ip)
+			}
+		}
+		for _, ip := range test.excludes {
+			if trie.contains(netip.MustParseAddr(ip)) {
+				t.Errorf("%s: %s is contained", test.name, ip)
+			}
+		}
+	}
+}
+
+func TestIPLists(t *testing.T) {
+	dir := t.TempDir()
+	blockFile := filepath.Join(dir, "block.txt")
+	if err := os.WriteFile(blockFile, []byte("# scanners\n198.51.100.0/24 # range\n\n  2001:db8::/32\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handle, err := newIPListsHandle(&IPLists{Allow: []string{"198.51.100.7", " 10.0.0.0/8 "}, BlockFiles: []string{blockFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want string
+		ok   bool
+	}{
+		// allow takes precedence over block
+		{"198.51.100.7", ipListAllow, true},
+		{"198.51.100.8", ipListBlock, true},
+		{"::ffff:198.51.100.8", ipListBlock, true},
+		{"2001:db8::1", ipListBlock, true},
+		{"10.1.2.3", ipListAllow, true},
+		{"203.0.113.7", "", false},
+		{"not an address", "", false},
+	}
+	for _, test := range tests {
+		got, ok := handle.match(test.ip)
+		if got != test.want || ok != test.ok {
+			t.Errorf("match(%s) = %q, %v, want %q, %v", test.ip, got, ok, test.want, test.ok)
+		}
+	}
+	var nilHandle *ipListsHandle
+	if _, ok := nilHandle.match("198.51.100.8"); ok {
+		t.Error("nil handle matched")
+	}
+}
+
+func TestIPListsErrors(t *testing.T) {
+	dir := t.TempDir()
+	badFile := filepath.Join(dir, "bad.txt")
+	if err := os.WriteFile(badFile, []byte("10.0.0.1\nhost.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config IPLists
+		want   string
+	}{
+		{"bad entry", IPLists{Block: []string{"10.0.0.0/40"}}, "ip_lists block 10.0.0.0/40 is not an address or a CIDR"},
+		{"bad file line", IPLists{AllowFiles: []string{badFile}}, "ip_lists allow_files " + badFile + ":2 host.example.com is not an address or a CIDR"},
+		{"missing file", IPLists{BlockFiles: []string{filepath.Join(dir, "missing.txt")}}, ""},
+		{"poll_interval", IPLists{PollInterval: "-1s"}, "ip_lists poll_interval -1s is not a positive duration"},
+	}
+	for _, test := range tests {
+		_, err := newIPListsHandle(&test.config)
+		if err == nil {
+			t.Errorf("%s: lists accepted", test.name)
+			continue
+		}
+		if len(test.want) != 0 && err.Error() != test.want {
+			t.Errorf("%s: error %q, want %q", test.name, err.Error(), test.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+//go:build lintconfig
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	xds "github.com/cncf/xds/go/xds/type/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+// main lints the waf-go-envoy plugin_config of the Envoy configuration files given as arguments,
+// running the same parser Envoy does, so that broken directives are found before the deployment.
+//
+//	go run -tags lintconfig ./plugin envoy.yaml
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: lintconfig envoy.yaml...")
+		os.Exit(2)
+	}
+	lintOnly = true
+	failed := false
+	for _, path := range os.Args[1:] {
+		errs := lintFile(path)
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+		}
+		if len(errs) != 0 {
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+type linter struct {
+	errs []error
+	// directive sets declared by the listener configs, the per-route directives must refer to one of them
+	directives map[string]struct{}
+	routes     map[string]string
+}
+
+func lintFile(path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []error{err}
+	}
+	l := &linter{directives: make(map[string]struct{}), routes: make(map[string]string)}
+	l.walk("", doc)
+	for _, location := range sortedKeys(l.routes) {
+		if _, ok := l.directives[l.routes[location]]; !ok {
+			l.report(location, errors.New(fmt.Sprintf("route directive %s does not exist", l.routes[location])))
+		}
+	}
+	return l.errs
+}
+
+func (l *linter) report(location string, err error) {
+	l.errs = append(l.errs, errors.New(fmt.Sprintf("%s: %s", location, err.Error())))
+}
+
+func (l *linter) walk(location string, node interface{}) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if n["plugin_name"] == pluginName {
+			l.lintPluginConfig(childLocation(location, "plugin_config"), n["plugin_config"], false)
+		}
+		if plugins, ok := n["plugins_config"].(map[string]interface{}); ok {
+			if plugin, ok := plugins[pluginName].(map[string]interface{}); ok {
+				l.lintPluginConfig(childLocation(location, "plugins_config."+pluginName+".config"), plugin["config"], true)
+			}
+		}
+		for _, key := range sortedKeys(n) {
+			l.walk(childLocation(location, key), n[key])
+		}
+	case []interface{}:
+		for i, child := range n {
+			l.walk(fmt.Sprintf("%s[%d]", location, i), child)
+		}
+	}
+}
+
+func childLocation(location, key string) string {
+	if len(location) == 0 {
+		return key
+	}
+	return location + "." + key
+}
+
+func (l *linter) lintPluginConfig(location string, node interface{}, perRoute bool) {
+	pluginConfig, ok := node.(map[string]interface{})
+	if !ok {
+		l.report(location, errors.New("plugin config is not exist"))
+		return
+	}
+	value, ok := pluginConfig["value"].(map[string]interface{})
+	if !ok {
+		l.report(location, errors.New("plugin config value is not exist"))
+		return
+	}
+	configValue, err := structpb.NewStruct(value)
+	if err != nil {
+		l.report(location, err)
+		return
+	}
+	any, err := anypb.New(&xds.TypedStruct{Value: configValue})
+	if err != nil {
+		l.report(location, err)
+		return
+	}
+	config, err := parser{}.parse(any, perRoute)
+	if err != nil {
+		var errs configErrors
+		if errors.As(err, &errs) {
+			for _, err := range errs {
+				l.report(location, err)
+			}
+			return
+		}
+		l.report(location, err)
+		return
+	}
+	switch c := config.(type) {
+	case *configuration:
+		for name := range c.directives {
+			l.directives[name] = struct{}{}
+		}
+	case *routeConfiguration:
+		if len(c.directive) != 0 {
+			l.routes[location] = c.directive
+		}
+	}
+}
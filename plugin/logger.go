@@ -1,10 +1,57 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+// jsonLogFormat is set from the log_format of the last accepted configuration setting it, the Envoy log is shared
+// by the whole process
+var jsonLogFormat atomic.Bool
+
+func parseLogFormat(format string) (bool, error) {
+	switch format {
+	case logFormatLogfmt:
+		return false, nil
+	case logFormatJSON:
+		return true, nil
+	}
+	return false, errors.New(fmt.Sprintf("log_format %s is not supported, use %s or %s", format, logFormatLogfmt, logFormatJSON))
+}
+
+// logAt logs with the logger of the Envoy process, which does not depend on a stream
+func logAt(level api.LogType, msg string) {
+	switch level {
+	case api.Trace:
+		api.LogTrace(msg)
+	case api.Debug:
+		api.LogDebug(msg)
+	case api.Info:
+		api.LogInfo(msg)
+	case api.Warn:
+		api.LogWarn(msg)
+	case api.Error:
+		api.LogError(msg)
+	default:
+		api.LogCritical(msg)
+	}
+}
+
 func BuildLoggerMessage() messageTemplate {
+	if jsonLogFormat.Load() {
+		return &jsonMessage{buff: []byte{'{'}}
+	}
 	buff := make([]byte, 0)
 	return &defaultMessage{buff: buff}
 }
@@ -12,28 +59,62 @@ func BuildLoggerMessage() messageTemplate {
 type messageTemplate interface {
 	msg(msg string) string
 	str(key, val string) messageTemplate
+	int(key string, val int) messageTemplate
+	duration(key string, val time.Duration) messageTemplate
+	bool(key string, val bool) messageTemplate
+	strs(key string, val []string) messageTemplate
 	err(err error) messageTemplate
 }
 
+// defaultMessage formats the fields as logfmt
 type defaultMessage struct {
 	buff []byte
 }
 
+func (d *defaultMessage) key(key string) {
+	if len(d.buff) != 0 {
+		d.buff = append(d.buff, ' ')
+	}
+	d.buff = append(d.buff, key...)
+	d.buff = append(d.buff, '=')
+}
+
 func (d *defaultMessage) msg(msg string) string {
 	if len(msg) == 0 {
 		return string(d.buff)
 	}
-	d.buff = append(d.buff, ' ')
-	d.buff = append(d.buff, "msg="...)
-	d.buff = append(d.buff, msg...)
+	d.key("msg")
+	d.buff = strconv.AppendQuote(d.buff, msg)
 	return string(d.buff)
 }
 
 func (d *defaultMessage) str(key, val string) messageTemplate {
-	d.buff = append(d.buff, ' ')
-	d.buff = append(d.buff, key...)
-	d.buff = append(d.buff, '=')
-	d.buff = append(d.buff, strconv.Quote(val)...)
+	d.key(key)
+	d.buff = strconv.AppendQuote(d.buff, val)
+	return d
+}
+
+func (d *defaultMessage) int(key string, val int) messageTemplate {
+	d.key(key)
+	d.buff = strconv.AppendInt(d.buff, int64(val), 10)
+	return d
+}
+
+func (d *defaultMessage) duration(key string, val time.Duration) messageTemplate {
+	d.key(key)
+	d.buff = append(d.buff, val.String()...)
+	return d
+}
+
+func (d *defaultMessage) bool(key string, val bool) messageTemplate {
+	d.key(key)
+	d.buff = strconv.AppendBool(d.buff, val)
+	return d
+}
+
+func (d *defaultMessage) strs(key string, val []string) messageTemplate {
+	d.key(key)
+	d.buff = strconv.AppendQuote(d.buff, strings.Join(val, ","))
 	return d
 }
 
@@ -41,8 +122,83 @@ func (d *defaultMessage) err(err error) messageTemplate {
 	if err == nil {
 		return d
 	}
-	d.buff = append(d.buff, "error=\""...)
-	d.buff = append(d.buff, err.Error()...)
-	d.buff = append(d.buff, "\""...)
+	d.key("error")
+	d.buff = strconv.AppendQuote(d.buff, err.Error())
 	return d
 }
+
+// jsonMessage formats the fields as a JSON object
+type jsonMessage struct {
+	buff []byte
+}
+
+func (j *jsonMessage) key(key string) {
+	if len(j.buff) > 1 {
+		j.buff = append(j.buff, ',')
+	}
+	j.buff = appendJSONString(j.buff, key)
+	j.buff = append(j.buff, ':')
+}
+
+func (j *jsonMessage) msg(msg string) string {
+	if len(msg) != 0 {
+		j.key("msg")
+		j.buff = appendJSONString(j.buff, msg)
+	}
+	j.buff = append(j.buff, '}')
+	return string(j.buff)
+}
+
+func (j *jsonMessage) str(key, val string) messageTemplate {
+	j.key(key)
+	j.buff = appendJSONString(j.buff, val)
+	return j
+}
+
+func (j *jsonMessage) int(key string, val int) messageTemplate {
+	j.key(key)
+	j.buff = strconv.AppendInt(j.buff, int64(val), 10)
+	return j
+}
+
+func (j *jsonMessage) duration(key string, val time.Duration) messageTemplate {
+	j.key(key)
+	j.buff = appendJSONString(j.buff, val.String())
+	return j
+}
+
+func (j *jsonMessage) bool(key string, val bool) messageTemplate {
+	j.key(key)
+	j.buff = strconv.AppendBool(j.buff, val)
+	return j
+}
+
+func (j *jsonMessage) strs(key string, val []string) messageTemplate {
+	j.key(key)
+	j.buff = append(j.buff, '[')
+	for i, s := range val {
+		if i != 0 {
+			j.buff = append(j.buff, ',')
+		}
+		j.buff = appendJSONString(j.buff, s)
+	}
+	j.buff = append(j.buff, ']')
+	return j
+}
+
+func (j *jsonMessage) err(err error) messageTemplate {
+	if err == nil {
+		return j
+	}
+	j.key("error")
+	j.buff = appendJSONString(j.buff, err.Error())
+	return j
+}
+
+func appendJSONString(buff []byte, s string) []byte {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return append(buff, `""`...)
+	}
+	return append(buff, b...)
+}
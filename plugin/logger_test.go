@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"testing"
+	"time"
+)
+
+// testCommonCAPI discards the logs of the Envoy process, which is not there in the tests
+type testCommonCAPI struct{}
+
+func (testCommonCAPI) Log(api.LogType, string) {}
+
+func (testCommonCAPI) LogLevel() api.LogType {
+	return api.Error
+}
+
+func init() {
+	api.SetCommonCAPI(testCommonCAPI{})
+}
+
+func buildTestMessage(m messageTemplate) string {
+	return m.str("host", `example.com "quoted"`).
+		int("status", 403).
+		duration("spent", 1500*time.Millisecond).
+		bool("blocked", true).
+		strs("rules", []string{"941100", "942100"}).
+		err(errors.New("line\nbreak")).
+		err(nil).
+		msg("Request blocked")
+}
+
+func TestDefaultMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		// the fields keep their order, the strings are quoted and escaped
+		{"fields", buildTestMessage(&defaultMessage{}), `host="example.com \"quoted\"" status=403 spent=1.5s blocked=true rules="941100,942100" error="line\nbreak" msg="Request blocked"`},
+		{"empty message", (&defaultMessage{}).str("a", "").msg(""), `a=""`},
+		{"no field", (&defaultMessage{}).msg("tab\there"), `msg="tab\there"`},
+		{"unicode", (&defaultMessage{}).str("path", "/é\x00").msg(""), `path="/é\x00"`},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: %s, want %s", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestJSONMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		// the fields keep their order, the strings are escaped as JSON
+		{"fields", buildTestMessage(&jsonMessage{buff: []byte{'{'}}), `{"host":"example.com \"quoted\"","status":403,"spent":"1.5s","blocked":true,"rules":["941100","942100"],"error":"line\nbreak","msg":"Request blocked"}`},
+		{"empty message", (&jsonMessage{buff: []byte{'{'}}).str("a", "").msg(""), `{"a":""}`},
+		{"no field", (&jsonMessage{buff: []byte{'{'}}).msg(""), `{}`},
+		{"empty list", (&jsonMessage{buff: []byte{'{'}}).strs("rules", nil).msg(""), `{"rules":[]}`},
+		// the HTML characters are escaped too, the logs may be displayed in a browser
+		{"html", (&jsonMessage{buff: []byte{'{'}}).str("<k>", "a&b").msg(""), `{"\u003ck\u003e":"a\u0026b"}`},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: %s, want %s", test.name, test.got, test.want)
+		}
+		if !json.Valid([]byte(test.got)) {
+			t.Errorf("%s: %s is not JSON", test.name, test.got)
+		}
+	}
+}
+
+func TestBuildLoggerMessage(t *testing.T) {
+	defer jsonLogFormat.Store(jsonLogFormat.Load())
+	jsonLogFormat.Store(true)
+	if got := BuildLoggerMessage().int("a", 1).msg(""); got != `{"a":1}` {
+		t.Errorf("json format: %s", got)
+	}
+	jsonLogFormat.Store(false)
+	if got := BuildLoggerMessage().int("a", 1).msg(""); got != `a=1` {
+		t.Errorf("logfmt format: %s", got)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !lintconfig
+
+package main
+
+import (
+	"github.com/envoyproxy/envoy/contrib/golang/filters/http/source/go/pkg/http"
+)
+
+func init() {
+	http.RegisterHttpFilterConfigFactoryAndParser(pluginName, configFactory, &parser{})
+}
+
+func main() {
+
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/corazawaf/coraza/v3/types/variables"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// maskActionName is the action tagging the rules whose matches are masked in the response body instead of blocking it
+	maskActionName = "mask"
+	// maskDataKey and maskRuleIDsKey are the TX variables collecting the spans captured by the mask rules and their ids
+	maskDataKey    = "waf_go_envoy_mask_data"
+	maskRuleIDsKey = "waf_go_envoy_mask_rule_ids"
+	// maskByte replaces every byte of a masked span, the body keeps its length and its Content-Length stays valid
+	maskByte = '*'
+)
+
+func init() {
+	plugins.RegisterAction(maskActionName, func() plugintypes.Action {
+		return &maskAction{}
+	})
+}
+
+// maskAction records the match captured by the rule, it requires the capture action. Every match of the @rx
+// pattern of the rule is masked, the captured one ensures the pattern matches the body as received:
+//
+//	SecRule RESPONSE_BODY "@rx \b\d{4}-\d{4}-\d{4}-\d{4}\b" "id:1000,phase:4,capture,mask,block,..."
+type maskAction struct{}
+
+func (a *maskAction) Init(_ plugintypes.RuleMetadata, data string) error {
+	if len(data) > 0 {
+		return errors.New("mask does not take arguments")
+	}
+	return nil
+}
+
+func (a *maskAction) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	// the actions of a chained rule are evaluated with the id 0, the span can't be bound to the matched rule
+	if !tx.Capturing() || r.ID() == 0 {
+		return
+	}
+	captured := tx.Variables().TX().Get("0")
+	if len(captured) == 0 || len(captured[0]) == 0 {
+		return
+	}
+	tx.Variables().TX().Add(maskDataKey, captured[0])
+	tx.Variables().TX().Add(maskRuleIDsKey, strconv.Itoa(r.ID()))
+}
+
+func (a *maskAction) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// mask redacts every match of the mask rules instead of blocking the response, it reports whether the body
+// was masked. The response is still blocked when a rule without mask matched the body, when the operator of a
+// mask rule is not @rx, or when a captured span is not masked, e.g. after a transformation of the rule.
+func (f *filter) mask(buffer api.BufferInstance, interruption *types.Interruption) bool {
+	state, ok := f.tx.(plugintypes.TransactionState)
+	if !ok {
+		return false
+	}
+	spans := state.Variables().TX().Get(maskDataKey)
+	if len(spans) == 0 {
+		return false
+	}
+	maskRules := make(map[int]struct{})
+	for _, id := range state.Variables().TX().Get(maskRuleIDsKey) {
+		if ruleID, err := strconv.Atoi(id); err == nil {
+			maskRules[ruleID] = struct{}{}
+		}
+	}
+	var patterns []*regexp.Regexp
+	for _, matched := range f.tx.MatchedRules() {
+		if !matchedResponseBody(matched) {
+			continue
+		}
+		if _, ok := maskRules[matched.Rule().ID()]; !ok {
+			f.logStream(api.Debug, f.log().int("rule", matched.Rule().ID()).msg("Response body not masked, a rule without mask matched it"))
+			return false
+		}
+		pattern, err := maskPattern(matched.Rule().Raw())
+		if err != nil {
+			f.logStream(api.Debug, f.log().int("rule", matched.Rule().ID()).err(err).msg("Response body not masked"))
+			return false
+		}
+		patterns = append(patterns, pattern)
+	}
+	body, count, ok := maskBody(buffer.Bytes(), patterns, spans)
+	if !ok {
+		f.logStream(api.Debug, f.log().msg("Response body not masked, a captured span is not matched in the body"))
+		return false
+	}
+	buffer.Set(body)
+	f.masked = true
+	f.logStream(api.Info, f.log().int("rule", interruption.RuleID).int("spans", count).msg("Response body masked"))
+	metrics.maskedResponses.inc(f.directive, f.host)
+	f.setMetadata()
+	return true
+}
+
+// maskBody masks every match of the patterns, it reports false when a captured span is still in the masked body
+func maskBody(body []byte, patterns []*regexp.Regexp, spans []string) ([]byte, int, bool) {
+	masked := append([]byte(nil), body...)
+	count := 0
+	for _, pattern := range patterns {
+		for _, match := range pattern.FindAllIndex(body, -1) {
+			for i := match[0]; i < match[1]; i++ {
+				masked[i] = maskByte
+			}
+			if match[1] > match[0] {
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return nil, 0, false
+	}
+	for _, span := range spans {
+		if len(span) != 0 && bytes.Contains(masked, []byte(span)) {
+			return nil, 0, false
+		}
+	}
+	return masked, count, true
+}
+
+// maskPatterns caches the patterns of the mask rules by raw rule
+var maskPatterns sync.Map
+
+// maskPattern returns the regular expression of the @rx operator of the raw rule, compiled the way Coraza does
+func maskPattern(raw string) (*regexp.Regexp, error) {
+	if pattern, ok := maskPatterns.Load(raw); ok {
+		return pattern.(*regexp.Regexp), nil
+	}
+	operator, err := ruleOperator(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(operator, "@rx "):
+		operator = strings.TrimSpace(operator[len("@rx "):])
+	case strings.HasPrefix(operator, "@") || strings.HasPrefix(operator, "!"):
+		return nil, errors.New(fmt.Sprintf("mask requires the @rx operator, the rule uses %s", operator))
+	}
+	pattern, err := regexp.Compile("(?sm)" + operator)
+	if err != nil {
+		return nil, err
+	}
+	maskPatterns.Store(raw, pattern)
+	return pattern, nil
+}
+
+// ruleOperator returns the operator of a raw SecRule, `SecRule VARIABLES "OPERATOR" "ACTIONS"`
+func ruleOperator(raw string) (string, error) {
+	directive, rest, _ := strings.Cut(strings.TrimSpace(raw), " ")
+	if !strings.EqualFold(directive, "SecRule") {
+		return "", errors.New(fmt.Sprintf("mask rule is not a SecRule: %s", raw))
+	}
+	_, rest, ok := strings.Cut(strings.TrimLeft(rest, " "), " ")
+	rest = strings.TrimLeft(rest, " ")
+	if !ok || len(rest) == 0 || rest[0] != '"' {
+		return "", errors.New(fmt.Sprintf("mask rule operator is not quoted: %s", raw))
+	}
+	for i := 1; i < len(rest); i++ {
+		// the first quote which is not escaped ends the operator
+		if rest[i] == '"' && rest[i-1] != '\\' {
+			return rest[1:i], nil
+		}
+	}
+	return "", errors.New(fmt.Sprintf("mask rule operator is not terminated: %s", raw))
+}
+
+func matchedResponseBody(matched types.MatchedRule) bool {
+	for _, matchData := range matched.MatchedDatas() {
+		if matchData.Variable() == variables.ResponseBody {
+			return true
+		}
+	}
+	return false
+}
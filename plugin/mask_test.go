@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"regexp"
+	"testing"
+)
+
+func TestMaskPattern(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		ok   bool
+	}{
+		{`SecRule RESPONSE_BODY "@rx \d{4}-\d{4}" "id:1,phase:4,capture,mask"`, `(?sm)\d{4}-\d{4}`, true},
+		{`SecRule  RESPONSE_BODY  "@rx a\"b" "id:1"`, `(?sm)a\"b`, true},
+		// @rx is the default operator
+		{`SecRule RESPONSE_BODY "secret" "id:1"`, `(?sm)secret`, true},
+		{`SecRule RESPONSE_BODY "@pm secret" "id:1"`, "", false},
+		{`SecRule RESPONSE_BODY "!@rx secret" "id:1"`, "", false},
+		{`SecRule RESPONSE_BODY "@rx (" "id:1"`, "", false},
+		{`SecRule RESPONSE_BODY "@rx secret`, "", false},
+		{`SecAction "id:1,mask"`, "", false},
+	}
+	for _, test := range tests {
+		got, err := maskPattern(test.raw)
+		if (err == nil) != test.ok || (err == nil && got.String() != test.want) {
+			t.Errorf("maskPattern(%q) = %v, %v, want %q", test.raw, got, err, test.want)
+		}
+	}
+}
+
+func TestMaskBody(t *testing.T) {
+	card := regexp.MustCompile(`\d{4}-\d{4}`)
+	mail := regexp.MustCompile(`[a-z]+@example\.com`)
+	tests := []struct {
+		name     string
+		body     string
+		patterns []*regexp.Regexp
+		spans    []string
+		want     string
+		count    int
+		ok       bool
+	}{
+		{"single match", "card 1234-5678.", []*regexp.Regexp{card}, []string{"1234-5678"}, "card *********.", 1, true},
+		// every match is masked, not only the captured one
+		{"several matches", "1234-5678 and 8765-4321", []*regexp.Regexp{card}, []string{"1234-5678"}, "********* and *********", 2, true},
+		{"several rules", "1234-5678 bob@example.com", []*regexp.Regexp{card, mail}, []string{"1234-5678", "bob@example.com"}, "********* ***************", 2, true},
+		{"overlapping matches", "x1234-5678@example.com", []*regexp.Regexp{card, regexp.MustCompile(`\d+@example\.com`)}, []string{"1234-5678"}, "x*********************", 2, true},
+		// a span captured after a transformation is not matched in the body as received
+		{"transformed span", "CARD 1234-5678", []*regexp.Regexp{regexp.MustCompile(`card \d{4}-\d{4}`)}, []string{"card 1234-5678"}, "", 0, false},
+		{"no match", "nothing here", []*regexp.Regexp{card}, []string{"1234-5678"}, "", 0, false},
+	}
+	for _, test := range tests {
+		got, count, ok := maskBody([]byte(test.body), test.patterns, test.spans)
+		if string(got) != test.want || count != test.count || ok != test.ok {
+			t.Errorf("%s: maskBody = %q, %d, %v, want %q, %d, %v", test.name, got, count, ok, test.want, test.count, test.ok)
+		}
+	}
+}
+
+func TestMaskRule(t *testing.T) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`SecResponseBodyAccess On
+SecResponseBodyMimeType text/plain
+SecRule RESPONSE_BODY "@rx \b\d{4}-\d{4}\b" "id:1000,phase:4,capture,mask,deny"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	tx.ProcessURI("/", "GET", "HTTP/1.1")
+	tx.ProcessRequestHeaders()
+	if _, err := tx.ProcessRequestBody(); err != nil {
+		t.Fatal(err)
+	}
+	tx.AddResponseHeader("Content-Type", "text/plain")
+	tx.ProcessResponseHeaders(200, "HTTP/1.1")
+	body := "cards: 1234-5678, 8765-4321"
+	if _, _, err := tx.WriteResponseBody([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ProcessResponseBody(); err != nil {
+		t.Fatal(err)
+	}
+	spans := tx.(plugintypes.TransactionState).Variables().TX().Get(maskDataKey)
+	var patterns []*regexp.Regexp
+	for _, matched := range tx.MatchedRules() {
+		if matched.Rule().ID() != 1000 {
+			continue
+		}
+		pattern, err := maskPattern(matched.Rule().Raw())
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	got, count, ok := maskBody([]byte(body), patterns, spans)
+	if want := "cards: *********, *********"; string(got) != want || count != 2 || !ok {
+		t.Errorf("maskBody = %q, %d, %v, want %q", got, count, ok, want)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"strconv"
+)
+
+// anomalyScores maps the dynamic metadata keys to the CRS anomaly score variables
+var anomalyScores = map[string]string{
+	"inbound_anomaly_score":  "blocking_inbound_anomaly_score",
+	"outbound_anomaly_score": "blocking_outbound_anomaly_score",
+}
+
+// setMetadata exports the WAF decision as dynamic metadata under the plugin namespace, e.g. for
+// %DYNAMIC_METADATA(waf-go-envoy:action)% in access logs or for the filters running after this one.
+// Envoy only accepts dynamic metadata while the filter processes the stream, so it is set at the end
+// of each phase and before the local reply, not in OnLog.
+func (f *filter) setMetadata() {
+	tx := f.tx
+	if tx == nil {
+		return
+	}
+	metadata := f.callbacks.StreamInfo().DynamicMetadata()
+	metadata.Set(pluginName, "directive", f.directive)
+	metadata.Set(pluginName, "transaction_id", tx.ID())
+	ruleIDs := matchedRuleIDs(tx)
+	matchedRules := make([]interface{}, 0, len(ruleIDs))
+	for _, id := range ruleIDs {
+		matchedRules = append(matchedRules, id)
+	}
+	metadata.Set(pluginName, "matched_rule_ids", matchedRules)
+	interruption := tx.Interruption()
+	action := "pass"
+	if interruption != nil {
+		action = interruption.Action
+		if !f.enforcing() {
+			action = "detect"
+		} else if f.masked {
+			action = "mask"
+		}
+		metadata.Set(pluginName, "rule_id", interruption.RuleID)
+		metadata.Set(pluginName, "interrupted_phase", interruptionPhase(tx))
+	}
+	metadata.Set(pluginName, "action", action)
+	if state, ok := tx.(plugintypes.TransactionState); ok {
+		for key, variable := range anomalyScores {
+			if score, ok := txVariableInt(state, variable); ok {
+				metadata.Set(pluginName, key, score)
+			}
+		}
+	}
+}
+
+// txVariableInt reads an integer variable of the TX collection
+func txVariableInt(state plugintypes.TransactionState, key string) (int, bool) {
+	values := state.Variables().TX().Get(key)
+	if len(values) == 0 {
+		return 0, false
+	}
+	value, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"reflect"
+	"testing"
+)
+
+func TestSetMetadata(t *testing.T) {
+	const (
+		matchRule  = `SecRule ARGS:q "@streq attack" "id:1,phase:1,pass,log"`
+		denyRule   = `SecRule ARGS:q "@streq attack" "id:2,phase:1,deny,status:403,log"`
+		scoreRules = `SecAction "id:3,phase:1,pass,nolog,setvar:tx.blocking_inbound_anomaly_score=5,setvar:tx.blocking_outbound_anomaly_score=abc"`
+	)
+	tests := []struct {
+		name       string
+		directives string
+		ruleEngine ctypes.RuleEngineStatus
+		masked     bool
+		want       map[string]interface{}
+	}{
+		{"pass", "SecRuleEngine On\n" + matchRule, ctypes.RuleEngineOn, false, map[string]interface{}{
+			"directive": "waf1", "transaction_id": "test", "matched_rule_ids": []interface{}{1}, "action": "pass",
+		}},
+		{"deny", "SecRuleEngine On\n" + matchRule + "\n" + denyRule, ctypes.RuleEngineOn, false, map[string]interface{}{
+			"directive": "waf1", "transaction_id": "test", "matched_rule_ids": []interface{}{1, 2}, "action": "deny",
+			"rule_id": 2, "interrupted_phase": "1",
+		}},
+		// the interruptions of DetectionOnly are not enforced
+		{"detect", "SecRuleEngine On\n" + denyRule, ctypes.RuleEngineDetectionOnly, false, map[string]interface{}{
+			"directive": "waf1", "transaction_id": "test", "matched_rule_ids": []interface{}{2}, "action": "detect",
+			"rule_id": 2, "interrupted_phase": "1",
+		}},
+		{"mask", "SecRuleEngine On\n" + denyRule, ctypes.RuleEngineOn, true, map[string]interface{}{
+			"directive": "waf1", "transaction_id": "test", "matched_rule_ids": []interface{}{2}, "action": "mask",
+			"rule_id": 2, "interrupted_phase": "1",
+		}},
+		// the anomaly scores which are not integers are left out
+		{"anomaly scores", "SecRuleEngine On\n" + scoreRules, ctypes.RuleEngineOn, false, map[string]interface{}{
+			"directive": "waf1", "transaction_id": "test", "matched_rule_ids": []interface{}{3}, "action": "pass",
+			"inbound_anomaly_score": 5,
+		}},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{
+			callbacks: callbacks,
+			conf:      configuration{ruleEngine: test.ruleEngine},
+			directive: "waf1",
+			tx:        newTestTransaction(t, test.directives),
+			masked:    test.masked,
+		}
+		f.setMetadata()
+		if !reflect.DeepEqual(callbacks.metadata, test.want) {
+			t.Errorf("%s: metadata %v, want %v", test.name, callbacks.metadata, test.want)
+		}
+	}
+	// the metadata is only set once the transaction exists
+	callbacks := newTestCallbacks()
+	f := &filter{callbacks: callbacks, directive: "waf1"}
+	f.setMetadata()
+	if len(callbacks.metadata) != 0 {
+		t.Errorf("metadata %v without a transaction", callbacks.metadata)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	phaseRequestHeaders  = "request_headers"
+	phaseRequestBody     = "request_body"
+	phaseResponseHeaders = "response_headers"
+	phaseResponseBody    = "response_body"
+)
+
+// maxMetricSeries bounds the series of a metric, the host of the series over the limit is reported as "other",
+// since the Host header is chosen by the client
+const maxMetricSeries = 1000
+
+// latencyBuckets are the upper bounds, in seconds, of the processing latency histograms
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// metrics is shared by every configuration of the process, so that the series survive config updates
+var metrics = newWafMetrics()
+
+// wafMetrics is the in-plugin registry of the filter metrics, exposed in the Prometheus text format on metrics_address.
+// The Go filter API can neither define histograms nor labels on the Envoy stats, hence the registry.
+type wafMetrics struct {
+	requests            *counterVec
+	interruptions       *counterVec
+	rulesMatched        *counterVec
+	bodyTooLarge        *counterVec
+	processingErrors    *counterVec
+	phaseDuration       *histogramVec
+	auditLogsDropped    *counterVec
+	auditLogErrors      *counterVec
+	budgetExceeded      *counterVec
+	maskedResponses     *counterVec
+	ipListMatches       *counterVec
+	shadowDisagreements *counterVec
+}
+
+func newWafMetrics() *wafMetrics {
+	return &wafMetrics{
+		requests:            newCounterVec("waf_requests_inspected_total", "Requests inspected by the WAF.", "directive", "host"),
+		interruptions:       newCounterVec("waf_interruptions_total", "Interruptions raised by the WAF.", "directive", "host", "phase", "action", "status"),
+		rulesMatched:        newCounterVec("waf_rules_matched_total", "Rules matched by the WAF.", "directive", "rule_id"),
+		bodyTooLarge:        newCounterVec("waf_body_too_large_total", "Bodies over the body limit of the directive set.", "directive", "host", "phase"),
+		processingErrors:    newCounterVec("waf_processing_errors_total", "Errors of the filter and of Coraza, handled by the on_error policy.", "directive", "host", "operation"),
+		phaseDuration:       newHistogramVec("waf_phase_duration_seconds", "Time spent by the WAF in a phase of the stream.", latencyBuckets, "directive", "phase"),
+		auditLogsDropped:    newCounterVec("waf_audit_logs_dropped_total", "Audit logs dropped because the buffer of the sink is full.", "sink"),
+		auditLogErrors:      newCounterVec("waf_audit_log_errors_total", "Audit logs the sink failed to write.", "sink"),
+		budgetExceeded:      newCounterVec("waf_inspection_budget_exceeded_total", "Transactions which spent their inspection budget.", "directive", "host"),
+		maskedResponses:     newCounterVec("waf_responses_masked_total", "Response bodies masked instead of blocked.", "directive", "host"),
+		ipListMatches:       newCounterVec("waf_ip_list_matches_total", "Requests of the clients allowed or blocked by ip_lists.", "directive", "list"),
+		shadowDisagreements: newCounterVec("waf_shadow_disagreements_total", "Streams whose shadow directive set disagrees with the enforcing one.", "directive", "shadow_directive"),
+	}
+}
+
+func (m *wafMetrics) write(w *bufio.Writer) {
+	m.requests.write(w)
+	m.interruptions.write(w)
+	m.rulesMatched.write(w)
+	m.bodyTooLarge.write(w)
+	m.processingErrors.write(w)
+	m.phaseDuration.write(w)
+	m.auditLogsDropped.write(w)
+	m.auditLogErrors.write(w)
+	m.budgetExceeded.write(w)
+	m.maskedResponses.write(w)
+	m.ipListMatches.write(w)
+	m.shadowDisagreements.write(w)
+}
+
+func (m *wafMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buff := bufio.NewWriter(w)
+	m.write(buff)
+	_ = buff.Flush()
+}
+
+// metricsServer serves the metrics on a metrics_address, it is shared by the configurations using the address
+type metricsServer struct {
+	address string
+	server  *http.Server
+	// refs counts the handles of the configurations using the server, guarded by metricsServers
+	refs int
+}
+
+// metricsServers holds the metrics_address listeners by address, a listener is kept across config updates
+// as long as a configuration uses its address
+var metricsServers = struct {
+	sync.Mutex
+	servers map[string]*metricsServer
+}{servers: make(map[string]*metricsServer)}
+
+// metricsServerHandle is referenced by the configuration, the listener is closed once the configurations
+// using it, and therefore their handles, are garbage collected
+type metricsServerHandle struct {
+	server *metricsServer
+}
+
+func serveMetrics(address string) (*metricsServerHandle, error) {
+	if lintOnly {
+		return nil, nil
+	}
+	metricsServers.Lock()
+	defer metricsServers.Unlock()
+	s, ok := metricsServers.servers[address]
+	if !ok {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("metrics_address %s listen error:%s", address, err.Error()))
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		s = &metricsServer{address: address, server: &http.Server{Handler: mux}}
+		metricsServers.servers[address] = s
+		go func() {
+			err := s.server.Serve(listener)
+			if errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+			api.LogError(BuildLoggerMessage().str("metrics_address", address).err(err).msg("Metrics server stopped"))
+		}()
+	}
+	s.refs++
+	handle := &metricsServerHandle{server: s}
+	runtime.SetFinalizer(handle, func(h *metricsServerHandle) {
+		h.server.release()
+	})
+	return handle, nil
+}
+
+// release closes the listener once no configuration uses its address
+func (s *metricsServer) release() {
+	metricsServers.Lock()
+	defer metricsServers.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(metricsServers.servers, s.address)
+	_ = s.server.Close()
+}
+
+// metricFamily holds the series of a metric by label values
+type metricFamily[S any] struct {
+	name   string
+	help   string
+	labels []string
+	host   int
+	mu     sync.RWMutex
+	series map[string]*S
+	values map[string][]string
+	create func() *S
+}
+
+func newMetricFamily[S any](name, help string, labels []string, create func() *S) metricFamily[S] {
+	host := -1
+	for i, label := range labels {
+		if label == "host" {
+			host = i
+		}
+	}
+	return metricFamily[S]{
+		name:   name,
+		help:   help,
+		labels: labels,
+		host:   host,
+		series: make(map[string]*S),
+		values: make(map[string][]string),
+		create: create,
+	}
+}
+
+// with returns the series of the label values, creating it on first use
+func (m *metricFamily[S]) with(values ...string) *S {
+	key := strings.Join(values, "\xff")
+	m.mu.RLock()
+	s, ok := m.series[key]
+	m.mu.RUnlock()
+	if ok {
+		return s
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	if len(m.series) >= maxMetricSeries && m.host >= 0 && values[m.host] != "other" {
+		values = append([]string(nil), values...)
+		values[m.host] = "other"
+		key = strings.Join(values, "\xff")
+		if s, ok := m.series[key]; ok {
+			return s
+		}
+	}
+	s = m.create()
+	m.series[key] = s
+	m.values[key] = values
+	return s
+}
+
+// each calls fn with the label pairs of every series, in a stable order
+func (m *metricFamily[S]) each(fn func(labels string, s *S)) {
+	m.mu.RLock()
+	keys := sortedKeys(m.series)
+	series := make([]*S, len(keys))
+	values := make([][]string, len(keys))
+	for i, key := range keys {
+		series[i], values[i] = m.series[key], m.values[key]
+	}
+	m.mu.RUnlock()
+	for i := range keys {
+		fn(formatLabels(m.labels, values[i]), series[i])
+	}
+}
+
+func (m *metricFamily[S]) writeHeader(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, kind)
+}
+
+type counter struct {
+	value atomic.Uint64
+}
+
+type counterVec struct {
+	metricFamily[counter]
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{newMetricFamily(name, help, labels, func() *counter { return &counter{} })}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.with(values...).value.Add(1)
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.writeHeader(w, "counter")
+	c.each(func(labels string, s *counter) {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, labels, s.value.Load())
+	})
+}
+
+type histogram struct {
+	buckets []atomic.Uint64
+	count   atomic.Uint64
+	// sum is the float64 bits of the sum of the observations, in seconds
+	sum atomic.Uint64
+}
+
+type histogramVec struct {
+	metricFamily[histogram]
+	bounds []float64
+}
+
+func newHistogramVec(name, help string, bounds []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		metricFamily: newMetricFamily(name, help, labels, func() *histogram {
+			return &histogram{buckets: make([]atomic.Uint64, len(bounds))}
+		}),
+		bounds: bounds,
+	}
+}
+
+func (h *histogramVec) observe(duration time.Duration, values ...string) {
+	s := h.with(values...)
+	seconds := duration.Seconds()
+	if i := sort.SearchFloat64s(h.bounds, seconds); i < len(h.bounds) {
+		s.buckets[i].Add(1)
+	}
+	s.count.Add(1)
+	for {
+		old := s.sum.Load()
+		if s.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+seconds)) {
+			break
+		}
+	}
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w, "histogram")
+	h.each(func(labels string, s *histogram) {
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += s.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		count := s.count.Load()
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, labels, strconv.FormatFloat(math.Float64frombits(s.sum.Load()), 'g', -1, 64))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, labels, count)
+	})
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=\"" + labelValueEscaper.Replace(values[i]) + "\""
+	}
+	return strings.Join(pairs, ",")
+}
+
+// observePhase records the time spent in the phase since start, once the transaction exists
+func (f *filter) observePhase(phase string, start time.Time) {
+	if f.tx == nil {
+		return
+	}
+	metrics.phaseDuration.observe(time.Since(start), f.directive, phase)
+}
+
+// processingError counts an error returned by the Coraza operation
+func (f *filter) processingError(operation string) {
+	metrics.processingErrors.inc(f.directive, f.host, operation)
+}
+
+// interruptedPhase names the phase of the rule which interrupted the transaction, the body limit
+// interruptions have no rule and are raised while writing the body being processed
+func (f *filter) interruptedPhase() string {
+	switch interruptionPhase(f.tx) {
+	case "1":
+		return phaseRequestHeaders
+	case "2":
+		return phaseRequestBody
+	case "3":
+		return phaseResponseHeaders
+	case "4":
+		return phaseResponseBody
+	}
+	if !f.processRequestBody {
+		return phaseRequestBody
+	}
+	return phaseResponseBody
+}
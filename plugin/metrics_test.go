@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMetric(write func(w *bufio.Writer)) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	write(w)
+	_ = w.Flush()
+	return b.String()
+}
+
+func TestCounterVecSeriesCap(t *testing.T) {
+	c := newCounterVec("waf_test_total", "Test.", "directive", "host")
+	for i := 0; i < maxMetricSeries; i++ {
+		c.inc("waf1", "host"+strconv.Itoa(i)+".example.com")
+	}
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		// the series over the limit are reported under the "other" host
+		{"new host", []string{"waf1", "new.example.com"}, `waf_test_total{directive="waf1",host="other"} 1`},
+		{"another new host", []string{"waf1", "another.example.com"}, `waf_test_total{directive="waf1",host="other"} 2`},
+		{"other host", []string{"waf1", "other"}, `waf_test_total{directive="waf1",host="other"} 3`},
+		// the existing series keep counting
+		{"existing host", []string{"waf1", "host7.example.com"}, `waf_test_total{directive="waf1",host="host7.example.com"} 2`},
+		{"new directive", []string{"waf2", "new.example.com"}, `waf_test_total{directive="waf2",host="other"} 1`},
+	}
+	for _, test := range tests {
+		c.inc(test.values...)
+		if got := writeMetric(c.write); !strings.Contains(got, test.want+"\n") {
+			t.Errorf("%s: %q is not written", test.name, test.want)
+		}
+	}
+	if got := len(c.series); got != maxMetricSeries+2 {
+		t.Errorf("%d series, want %d", got, maxMetricSeries+2)
+	}
+	// a metric without host label is not capped by host
+	rules := newCounterVec("waf_rules_total", "Test.", "directive", "rule_id")
+	for i := 0; i <= maxMetricSeries; i++ {
+		rules.inc("waf1", strconv.Itoa(i))
+	}
+	if got := len(rules.series); got != maxMetricSeries+1 {
+		t.Errorf("%d series without host label, want %d", got, maxMetricSeries+1)
+	}
+}
+
+func TestMetricsWrite(t *testing.T) {
+	c := newCounterVec("waf_test_total", "Test.", "directive", "host")
+	c.inc("waf2", "b.example.com")
+	c.inc("waf1", `a"\`+"\n")
+	c.inc("waf1", `a"\`+"\n")
+	h := newHistogramVec("waf_test_seconds", "Test.", []float64{0.001, 0.01}, "directive")
+	h.observe(500*time.Microsecond, "waf1")
+	h.observe(5*time.Millisecond, "waf1")
+	h.observe(time.Second, "waf1")
+	tests := []struct {
+		name  string
+		write func(w *bufio.Writer)
+		want  string
+	}{
+		// the series are sorted and the label values escaped
+		{"counter", c.write, `# HELP waf_test_total Test.
+# TYPE waf_test_total counter
+waf_test_total{directive="waf1",host="a\"\\\n"} 2
+waf_test_total{directive="waf2",host="b.example.com"} 1
+`},
+		// the buckets are cumulative
+		{"histogram", h.write, `# HELP waf_test_seconds Test.
+# TYPE waf_test_seconds histogram
+waf_test_seconds_bucket{directive="waf1",le="0.001"} 1
+waf_test_seconds_bucket{directive="waf1",le="0.01"} 2
+waf_test_seconds_bucket{directive="waf1",le="+Inf"} 3
+waf_test_seconds_sum{directive="waf1"} 1.0055
+waf_test_seconds_count{directive="waf1"} 3
+`},
+	}
+	for _, test := range tests {
+		if got := writeMetric(test.write); got != test.want {
+			t.Errorf("%s: wrote %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"net/http"
+)
+
+const (
+	// onErrorPolicyOpen lets the stream continue when the filter fails, the default
+	onErrorPolicyOpen = "open"
+	// onErrorPolicyClosed rejects the stream when the filter fails
+	onErrorPolicyClosed = "closed"
+
+	defaultOnErrorStatus = http.StatusServiceUnavailable
+)
+
+// OnError configures what the filter does with a stream it fails to inspect
+type OnError struct {
+	// Policy is open or closed
+	Policy string `json:"policy"`
+	// Status is the status of the local reply of the closed policy, 503 by default
+	Status int `json:"status"`
+}
+
+type onErrorPolicy struct {
+	closed bool
+	status int
+}
+
+func newOnErrorPolicy(name string, config *OnError) (*onErrorPolicy, error) {
+	p := &onErrorPolicy{status: defaultOnErrorStatus}
+	switch config.Policy {
+	case "", onErrorPolicyOpen:
+	case onErrorPolicyClosed:
+		p.closed = true
+	default:
+		return nil, errors.New(fmt.Sprintf("%s on_error policy %s is not supported, use %s or %s", name, config.Policy, onErrorPolicyOpen, onErrorPolicyClosed))
+	}
+	if config.Status != 0 {
+		if config.Status < 400 || config.Status > 599 {
+			return nil, errors.New(fmt.Sprintf("%s on_error status %d is not an error status", name, config.Status))
+		}
+		p.status = config.Status
+	}
+	return p, nil
+}
+
+// onError counts the failed operation and applies the on_error policy of the directive set: open lets the stream
+// continue, what is left of the transaction is still inspected, closed rejects it. It reports whether the stream
+// was rejected.
+func (f *filter) onError(operation string) (api.StatusType, bool) {
+	f.processingError(operation)
+	f.callbacks.StreamInfo().DynamicMetadata().Set(pluginName, "error", operation)
+	policy := f.conf.onErrorPolicies[f.directive]
+	if policy == nil || !policy.closed {
+		return api.Continue, false
+	}
+	f.isInterruption = true
+	headers := map[string]string{}
+	if f.conf.setTransactionIDHeader && f.tx != nil {
+		headers[f.conf.transactionIDHeader] = f.tx.ID()
+	}
+	f.logStream(api.Info, f.log().str("operation", operation).int("status", policy.status).msg("Rejecting the stream, on_error policy is closed"))
+	f.callbacks.SendLocalReply(policy.status, "", headers, 0, "WAF error in "+operation)
+	return api.LocalReply, true
+}
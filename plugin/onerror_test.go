@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"reflect"
+	"testing"
+)
+
+func TestNewOnErrorPolicy(t *testing.T) {
+	tests := []struct {
+		config OnError
+		closed bool
+		status int
+		ok     bool
+	}{
+		{OnError{}, false, defaultOnErrorStatus, true},
+		{OnError{Policy: onErrorPolicyOpen}, false, defaultOnErrorStatus, true},
+		{OnError{Policy: onErrorPolicyClosed}, true, defaultOnErrorStatus, true},
+		{OnError{Policy: onErrorPolicyClosed, Status: 500}, true, 500, true},
+		{OnError{Policy: onErrorPolicyClosed, Status: 400}, true, 400, true},
+		{OnError{Policy: onErrorPolicyClosed, Status: 599}, true, 599, true},
+		{OnError{Policy: "Closed"}, false, 0, false},
+		{OnError{Policy: "fail"}, false, 0, false},
+		{OnError{Policy: onErrorPolicyClosed, Status: 200}, false, 0, false},
+		{OnError{Policy: onErrorPolicyClosed, Status: 399}, false, 0, false},
+		{OnError{Policy: onErrorPolicyClosed, Status: 600}, false, 0, false},
+	}
+	for _, test := range tests {
+		p, err := newOnErrorPolicy("waf1", &test.config)
+		if (err == nil) != test.ok {
+			t.Errorf("newOnErrorPolicy(%+v) = %v", test.config, err)
+			continue
+		}
+		if err == nil && (p.closed != test.closed || p.status != test.status) {
+			t.Errorf("newOnErrorPolicy(%+v) = %+v, want closed %v, status %d", test.config, *p, test.closed, test.status)
+		}
+	}
+}
+
+func TestOnError(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *onErrorPolicy
+		idHeader bool
+		want     api.StatusType
+		rejected bool
+		replies  []int
+		headers  []map[string]string
+	}{
+		// a directive set without on_error is open
+		{"no policy", nil, false, api.Continue, false, nil, nil},
+		{"open", &onErrorPolicy{status: defaultOnErrorStatus}, false, api.Continue, false, nil, nil},
+		{"closed", &onErrorPolicy{closed: true, status: defaultOnErrorStatus}, false, api.LocalReply, true, []int{503}, []map[string]string{{}}},
+		{"closed status", &onErrorPolicy{closed: true, status: 500}, false, api.LocalReply, true, []int{500}, []map[string]string{{}}},
+		{"closed transaction id", &onErrorPolicy{closed: true, status: 503}, true, api.LocalReply, true, []int{503}, []map[string]string{{"x-request-id": "test"}}},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{
+			callbacks: callbacks,
+			conf: configuration{
+				onErrorPolicies:        map[string]*onErrorPolicy{"waf1": test.policy},
+				setTransactionIDHeader: test.idHeader,
+				transactionIDHeader:    "x-request-id",
+			},
+			directive: "waf1",
+			host:      "on-error.example.com",
+			tx:        newTestTransaction(t, "SecRuleEngine On"),
+		}
+		counter := metrics.processingErrors.with("waf1", "on-error.example.com", "Test")
+		count := counter.value.Load()
+		got, rejected := f.onError("Test")
+		if got != test.want || rejected != test.rejected || f.isInterruption != test.rejected {
+			t.Errorf("%s: onError = %v, %v, interruption %v, want %v, %v", test.name, got, rejected, f.isInterruption, test.want, test.rejected)
+		}
+		if !reflect.DeepEqual(callbacks.replies, test.replies) || !reflect.DeepEqual(callbacks.headers, test.headers) {
+			t.Errorf("%s: replies %v %v, want %v %v", test.name, callbacks.replies, callbacks.headers, test.replies, test.headers)
+		}
+		// the error is counted and exported whatever the policy
+		if callbacks.metadata["error"] != "Test" {
+			t.Errorf("%s: error metadata %v", test.name, callbacks.metadata["error"])
+		}
+		if got := counter.value.Load() - count; got != 1 {
+			t.Errorf("%s: %d errors counted", test.name, got)
+		}
+	}
+}
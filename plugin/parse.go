@@ -7,15 +7,27 @@ import (
 	"github.com/corazawaf/coraza/v3"
 	ctypes "github.com/corazawaf/coraza/v3/types"
 	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
-	"github.com/envoyproxy/envoy/contrib/golang/filters/http/source/go/pkg/http"
-	jsoniter "github.com/json-iterator/go"
 	"google.golang.org/protobuf/types/known/anypb"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func init() {
-	http.RegisterHttpFilterConfigFactoryAndParser("waf-go-envoy", configFactory, &parser{})
-}
+const defaultTransactionIDHeader = "x-request-id"
+
+const (
+	// requestBodyModeBuffer holds the request until its whole body is inspected
+	requestBodyModeBuffer = "buffer"
+	// requestBodyModeStream forwards every chunk of the request body once it is written to the transaction,
+	// only the last chunk waits for ProcessRequestBody. The upstream may receive the body of a request
+	// which is interrupted afterwards by a request body rule.
+	requestBodyModeStream = "stream"
+)
 
 type parser struct {
 }
@@ -24,7 +36,71 @@ type configuration struct {
 	directives       WafDirectives
 	defaultDirective string
 	hostDirectiveMap HostDirectiveMap
-	wafMaps          wafMaps
+	hostMatcher      *hostMatcher
+	routeMatcher     *routeMatcher
+	// shadow directive sets are evaluated alongside the enforcing ones, their interruptions are never enforced
+	defaultShadowDirective string
+	shadowMatcher          *hostMatcher
+	// wafMaps is swapped when the rules of rules_dir are reloaded
+	wafMaps      *atomic.Pointer[wafMaps]
+	ruleEngine   ctypes.RuleEngineStatus
+	rulesWatcher *rulesWatcherHandle
+	// transactionIDHeader carries the id of the Coraza transaction, it is generated when the request misses it
+	transactionIDHeader    string
+	setTransactionIDHeader bool
+	// blockResponses customizes the local replies of the directive sets, by directive set name
+	blockResponses map[string]*blockResponse
+	// streamRequestBody holds the directive sets with the stream request_body_mode
+	streamRequestBody map[string]bool
+	// requestBodyContentTypes and responseBodyContentTypes are the allowlists of the inspected bodies, by directive set name
+	requestBodyContentTypes  map[string]contentTypes
+	responseBodyContentTypes map[string]contentTypes
+	// maxDecompressedBodySize caps the bodies decompressed for the inspection
+	maxDecompressedBodySize int
+	// onErrorPolicies holds the fail policies of the directive sets, by directive set name
+	onErrorPolicies map[string]*onErrorPolicy
+	// collectionStores holds the persistent collection stores, by directive set name
+	collectionStores map[string]*collectionStoreHandle
+	// metricsServer serves the metrics on metrics_address
+	metricsServer *metricsServerHandle
+	// auditSinks holds the audit log sinks, by directive set name
+	auditSinks map[string]*auditSinkHandle
+	// geoDatabase sets the GEO variables of the client address, it is set by geoip_database
+	geoDatabase *geoDatabase
+	// ipLists holds the allowed and blocked clients checked before the transactions are created
+	ipLists *ipListsHandle
+	// clientIPResolver resolves the client address given to the transactions
+	clientIPResolver *clientIPResolver
+	// inspectionPool is set when async_inspection is enabled
+	inspectionPool   inspectionPool
+	inspectionBudget time.Duration
+}
+
+// directive returns the name of the directive set applied to the request,
+// route_directive_map takes precedence over host_directive_map
+func (c *configuration) directive(host, path, method string) string {
+	if directive, ok := c.routeMatcher.match(host, path, method); ok {
+		return directive
+	}
+	if directive, ok := c.hostMatcher.match(host); ok {
+		return directive
+	}
+	return c.defaultDirective
+}
+
+// shadowDirective returns the name of the shadow directive set of the host, if any
+func (c *configuration) shadowDirective(host string) (string, bool) {
+	if directive, ok := c.shadowMatcher.match(host); ok {
+		return directive, true
+	}
+	return c.defaultShadowDirective, len(c.defaultShadowDirective) != 0
+}
+
+// routeConfiguration is the per-route override of the listener configuration,
+// it is merged on top of the listener configuration by parser.Merge
+type routeConfiguration struct {
+	directive  string
+	ruleEngine *ctypes.RuleEngineStatus
 }
 
 type wafMaps map[string]coraza.WAF
@@ -32,25 +108,44 @@ type wafMaps map[string]coraza.WAF
 type WafDirectives map[string]Directives
 
 type Directives struct {
-	SimpleDirectives []string `json:"simple_directives"`
+	SimpleDirectives []string       `json:"simple_directives"`
+	BlockResponse    *BlockResponse `json:"block_response"`
+	AuditLog         *AuditLog      `json:"audit_log"`
+	// RequestBodyMode is buffer (the default) or stream, see requestBodyModeStream
+	RequestBodyMode string `json:"request_body_mode"`
+	// RequestBodyContentTypes and ResponseBodyContentTypes restrict the inspection of the bodies to their media types
+	RequestBodyContentTypes  []string `json:"request_body_content_types"`
+	ResponseBodyContentTypes []string `json:"response_body_content_types"`
+	// PersistentCollections enables the store of the collections loaded by initcol, e.g. IP
+	PersistentCollections *PersistentCollections `json:"persistent_collections"`
+	// OnError overrides the on_error policy of the configuration for the directive set
+	OnError *OnError `json:"on_error"`
 }
 
 type HostDirectiveMap map[string]string
 
+// Parse parses the configuration of the filter, Envoy passes no callbacks for the per-route configurations
 func (p parser) Parse(any *anypb.Any, callbacks api.ConfigCallbackHandler) (interface{}, error) {
+	return p.parse(any, callbacks == nil)
+}
+
+// parse parses a listener configuration, or a per-route one when perRoute is set. A per-route configuration is
+// either complete or only overrides the directive and rule_engine of the listener one, see routeConfiguration.
+func (p parser) parse(any *anypb.Any, perRoute bool) (interface{}, error) {
 	configStruct := &xds.TypedStruct{}
 	if err := any.UnmarshalTo(configStruct); err != nil {
 		return nil, err
 	}
 	v := configStruct.Value
+	if _, ok := v.AsMap()["directives"]; !ok && perRoute && isRouteConfig(v.AsMap()) {
+		return parseRouteConfig(v.AsMap())
+	}
 	var config configuration
-	json := jsoniter.ConfigCompatibleWithStandardLibrary
-	if directivesString, ok := v.AsMap()["directives"].(string); ok {
-		var wafDirectives WafDirectives
-		err := json.UnmarshalFromString(directivesString, &wafDirectives)
-		if err != nil {
-			return nil, err
-		}
+	var errs configErrors
+	var wafDirectives WafDirectives
+	if ok, err := decodeConfigField(v.AsMap(), "directives", &wafDirectives); err != nil {
+		return nil, err
+	} else if ok {
 		if len(wafDirectives) == 0 {
 			return nil, errors.New("directives is empty")
 		}
@@ -61,46 +156,431 @@ func (p parser) Parse(any *anypb.Any, callbacks api.ConfigCallbackHandler) (inte
 	if defaultDirectiveString, ok := v.AsMap()["default_directive"].(string); ok {
 		_, ok := config.directives[defaultDirectiveString]
 		if !ok {
-			return nil, errors.New("default_directive is not exist")
+			errs = append(errs, errors.New("default_directive is not exist"))
 		}
 		config.defaultDirective = defaultDirectiveString
 	} else {
-		return nil, errors.New("default_directive is not exist")
+		errs = append(errs, errors.New("default_directive is not exist"))
 	}
 
-	if hostDirectiveMapString, ok := v.AsMap()["host_directive_map"].(string); ok {
-		hostDirectiveMap := make(HostDirectiveMap)
-		err := json.UnmarshalFromString(hostDirectiveMapString, &hostDirectiveMap)
+	hostDirectiveMap := make(HostDirectiveMap)
+	if ok, err := decodeConfigField(v.AsMap(), "host_directive_map", &hostDirectiveMap); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		for _, host := range sortedKeys(hostDirectiveMap) {
+			_, ok := config.directives[hostDirectiveMap[host]]
+			if !ok {
+				errs = append(errs, errors.New(fmt.Sprintf("The rule corresponding to %s does not exist", host)))
+			}
+		}
+		config.hostDirectiveMap = hostDirectiveMap
+		hostMatcher, err := newHostMatcher(hostDirectiveMap)
 		if err != nil {
-			return nil, err
+			errs = append(errs, err)
 		}
-		for host, rule := range hostDirectiveMap {
-			_, ok := config.directives[rule]
+		config.hostMatcher = hostMatcher
+	}
+	var routeDirectiveMap RouteDirectiveMap
+	if ok, err := decodeConfigField(v.AsMap(), "route_directive_map", &routeDirectiveMap); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		for i, route := range routeDirectiveMap {
+			_, ok := config.directives[route.Directive]
 			if !ok {
-				return nil, errors.New(fmt.Sprintf("The rule corresponding to %s does not exist", host))
+				errs = append(errs, errors.New(fmt.Sprintf("The rule corresponding to route_directive_map[%d] does not exist", i)))
 			}
 		}
-		config.hostDirectiveMap = hostDirectiveMap
-		wafMaps := make(wafMaps)
-		for wafName, wafRules := range config.directives {
-			wafConfig := coraza.NewWAFConfig().WithErrorCallback(errorCallback).WithRootFS(root).WithDirectives(strings.Join(wafRules.SimpleDirectives, "\n"))
-			waf, err := coraza.NewWAF(wafConfig)
+		routeMatcher, err := newRouteMatcher(routeDirectiveMap)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.routeMatcher = routeMatcher
+	}
+	if shadowDirectiveString, ok := v.AsMap()["shadow_directive"].(string); ok {
+		_, ok := config.directives[shadowDirectiveString]
+		if !ok {
+			errs = append(errs, errors.New("shadow_directive is not exist"))
+		}
+		config.defaultShadowDirective = shadowDirectiveString
+	}
+	shadowDirectiveMap := make(HostDirectiveMap)
+	if ok, err := decodeConfigField(v.AsMap(), "shadow_directive_map", &shadowDirectiveMap); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		for _, host := range sortedKeys(shadowDirectiveMap) {
+			_, ok := config.directives[shadowDirectiveMap[host]]
+			if !ok {
+				errs = append(errs, errors.New(fmt.Sprintf("The shadow rule corresponding to %s does not exist", host)))
+			}
+		}
+		shadowMatcher, err := newHostMatcher(shadowDirectiveMap)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.shadowMatcher = shadowMatcher
+	}
+	config.transactionIDHeader = defaultTransactionIDHeader
+	if transactionIDHeaderString, ok := v.AsMap()["transaction_id_header"].(string); ok {
+		if len(transactionIDHeaderString) == 0 {
+			errs = append(errs, errors.New("transaction_id_header is empty"))
+		}
+		config.transactionIDHeader = strings.ToLower(transactionIDHeaderString)
+	}
+	if setTransactionIDHeader, ok := v.AsMap()["set_transaction_id_header"].(bool); ok {
+		config.setTransactionIDHeader = setTransactionIDHeader
+	}
+	if ruleEngineString, ok := v.AsMap()["rule_engine"].(string); ok {
+		ruleEngine, err := ctypes.ParseRuleEngineStatus(ruleEngineString)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.ruleEngine = ruleEngine
+	}
+	rootFS := root
+	rulesDir, hasRulesDir := v.AsMap()["rules_dir"].(string)
+	if hasRulesDir {
+		rootFS = withRulesDir(rulesDir)
+	}
+	rulesDirPollInterval := defaultRulesDirPollInterval
+	if intervalString, ok := v.AsMap()["rules_dir_poll_interval"].(string); ok {
+		interval, err := time.ParseDuration(intervalString)
+		if err != nil || interval <= 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("rules_dir_poll_interval %s is not a positive duration", intervalString)))
+		}
+		rulesDirPollInterval = interval
+	}
+	var clientIP ClientIP
+	if ok, err := decodeConfigField(v.AsMap(), "client_ip", &clientIP); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		clientIPResolver, err := newClientIPResolver(&clientIP)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.clientIPResolver = clientIPResolver
+	}
+	if geoIPDatabase, ok := v.AsMap()["geoip_database"].(string); ok {
+		geoDatabase, err := loadGeoDatabase(geoIPDatabase)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.geoDatabase = geoDatabase
+	}
+	var ipListsConfig IPLists
+	if ok, err := decodeConfigField(v.AsMap(), "ip_lists", &ipListsConfig); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		ipLists, err := newIPListsHandle(&ipListsConfig)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.ipLists = ipLists
+	}
+	if asyncInspection, ok := v.AsMap()["async_inspection"].(bool); ok && asyncInspection {
+		workers := runtime.GOMAXPROCS(0)
+		if asyncWorkers, ok := v.AsMap()["async_workers"].(float64); ok {
+			if asyncWorkers < 1 || asyncWorkers != float64(int(asyncWorkers)) {
+				errs = append(errs, errors.New(fmt.Sprintf("async_workers %v is not a positive integer", asyncWorkers)))
+			}
+			workers = int(asyncWorkers)
+		}
+		if workers > 0 {
+			config.inspectionPool = newInspectionPool(workers)
+		}
+	}
+	if budgetString, ok := v.AsMap()["inspection_budget"].(string); ok {
+		budget, err := time.ParseDuration(budgetString)
+		if err != nil || budget <= 0 {
+			errs = append(errs, errors.New(fmt.Sprintf("inspection_budget %s is not a positive duration", budgetString)))
+		}
+		config.inspectionBudget = budget
+	}
+	config.maxDecompressedBodySize = defaultMaxDecompressedBodySize
+	if maxSize, ok := v.AsMap()["max_decompressed_body_size"].(float64); ok {
+		if maxSize < 1 || maxSize != float64(int(maxSize)) {
+			errs = append(errs, errors.New(fmt.Sprintf("max_decompressed_body_size %v is not a positive integer", maxSize)))
+		}
+		config.maxDecompressedBodySize = int(maxSize)
+	}
+	logFormat, hasLogFormat := v.AsMap()["log_format"].(string)
+	var jsonLog bool
+	if hasLogFormat {
+		var err error
+		if jsonLog, err = parseLogFormat(logFormat); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	metricsAddress, hasMetricsAddress := v.AsMap()["metrics_address"].(string)
+	if hasMetricsAddress {
+		if _, _, err := net.SplitHostPort(metricsAddress); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("metrics_address %s is not valid: %s", metricsAddress, err.Error())))
+		}
+	}
+	config.streamRequestBody = make(map[string]bool)
+	for _, wafName := range sortedKeys(config.directives) {
+		switch mode := config.directives[wafName].RequestBodyMode; mode {
+		case "", requestBodyModeBuffer:
+		case requestBodyModeStream:
+			config.streamRequestBody[wafName] = true
+		default:
+			errs = append(errs, errors.New(fmt.Sprintf("%s request_body_mode %s is not supported, use %s or %s", wafName, mode, requestBodyModeBuffer, requestBodyModeStream)))
+		}
+	}
+	config.requestBodyContentTypes = make(map[string]contentTypes)
+	config.responseBodyContentTypes = make(map[string]contentTypes)
+	for _, wafName := range sortedKeys(config.directives) {
+		requestBodyContentTypes, err := newContentTypes(wafName, "request_body_content_types", config.directives[wafName].RequestBodyContentTypes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.requestBodyContentTypes[wafName] = requestBodyContentTypes
+		responseBodyContentTypes, err := newContentTypes(wafName, "response_body_content_types", config.directives[wafName].ResponseBodyContentTypes)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		config.responseBodyContentTypes[wafName] = responseBodyContentTypes
+	}
+	defaultOnErrorPolicy := &onErrorPolicy{status: defaultOnErrorStatus}
+	var onError OnError
+	if ok, err := decodeConfigField(v.AsMap(), "on_error", &onError); err != nil {
+		errs = append(errs, err)
+	} else if ok {
+		if defaultOnErrorPolicy, err = newOnErrorPolicy("configuration", &onError); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	config.onErrorPolicies = make(map[string]*onErrorPolicy)
+	for _, wafName := range sortedKeys(config.directives) {
+		onErrorConfig := config.directives[wafName].OnError
+		if onErrorConfig == nil {
+			config.onErrorPolicies[wafName] = defaultOnErrorPolicy
+			continue
+		}
+		onErrorPolicy, err := newOnErrorPolicy(wafName, onErrorConfig)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		config.onErrorPolicies[wafName] = onErrorPolicy
+	}
+	collectionStoreRegistrations := make(map[string]*collectionStoreRegistration)
+	snapshotPaths := make(map[string]string)
+	for _, wafName := range sortedKeys(config.directives) {
+		if persistentCollections := config.directives[wafName].PersistentCollections; persistentCollections != nil {
+			if snapshotPath := persistentCollections.SnapshotPath; len(snapshotPath) != 0 {
+				if other, ok := snapshotPaths[filepath.Clean(snapshotPath)]; ok {
+					errs = append(errs, errors.New(fmt.Sprintf("%s persistent_collections snapshot_path %s is already the one of %s", wafName, snapshotPath, other)))
+					continue
+				}
+				snapshotPaths[filepath.Clean(snapshotPath)] = wafName
+			}
+			registration, err := prepareCollectionStore(wafName, persistentCollections)
 			if err != nil {
-				return nil, errors.New(fmt.Sprintf("%s mapping waf init error:%s", wafName, err.Error()))
+				errs = append(errs, errors.New(fmt.Sprintf("%s %s", wafName, err.Error())))
+				continue
+			}
+			collectionStoreRegistrations[wafName] = registration
+		}
+	}
+	config.blockResponses = make(map[string]*blockResponse)
+	for _, wafName := range sortedKeys(config.directives) {
+		if blockResponseConfig := config.directives[wafName].BlockResponse; blockResponseConfig != nil {
+			blockResponse, err := newBlockResponse(wafName, blockResponseConfig)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			config.blockResponses[wafName] = blockResponse
+		}
+	}
+	auditSinkRegistrations := make(map[string]*auditSinkRegistration)
+	auditSinkOwners := make(map[string]string)
+	for _, wafName := range sortedKeys(config.directives) {
+		auditLogConfig := config.directives[wafName].AuditLog
+		if auditLogConfig == nil {
+			continue
+		}
+		name, err := auditSinkName(auditLogConfig)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s %s", wafName, err.Error())))
+			continue
+		}
+		if other, ok := auditSinkOwners[name]; ok {
+			settings, _ := auditSinkSettings(auditLogConfig)
+			otherSettings, _ := auditSinkSettings(config.directives[other].AuditLog)
+			if settings != otherSettings {
+				errs = append(errs, errors.New(fmt.Sprintf("%s audit_log %s is already the one of %s with other settings", wafName, name, other)))
+				continue
 			}
-			wafMaps[wafName] = waf
+		} else {
+			auditSinkOwners[name] = wafName
+		}
+		registration, err := prepareAuditSink(auditLogConfig)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s %s", wafName, err.Error())))
+			continue
+		}
+		auditSinkRegistrations[wafName] = registration
+	}
+	// the sinks are registered once the configuration is accepted, until then the WAFs refer to them as pending
+	defer pendAuditSinks(auditSinkRegistrations)()
+	wafs := make(wafMaps)
+	for _, wafName := range sortedKeys(config.directives) {
+		if _, ok := auditSinkRegistrations[wafName]; !ok && config.directives[wafName].AuditLog != nil {
+			// the error of the sink is already reported
+			continue
+		}
+		waf, err := newWAF(rootFS, config.directives[wafName])
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s mapping waf init error:%s", wafName, err.Error())))
+			continue
 		}
-		config.wafMaps = wafMaps
+		wafs[wafName] = waf
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	if hasLogFormat {
+		// a configuration without log_format keeps the format of the process
+		jsonLogFormat.Store(jsonLog)
+	}
+	if hasMetricsAddress {
+		metricsServer, err := serveMetrics(metricsAddress)
+		if err != nil {
+			return nil, err
+		}
+		config.metricsServer = metricsServer
+	}
+	config.ipLists.start()
+	config.collectionStores = make(map[string]*collectionStoreHandle)
+	for _, wafName := range sortedKeys(collectionStoreRegistrations) {
+		config.collectionStores[wafName] = collectionStoreRegistrations[wafName].register()
+	}
+	config.auditSinks = make(map[string]*auditSinkHandle)
+	for _, wafName := range sortedKeys(auditSinkRegistrations) {
+		config.auditSinks[wafName] = auditSinkRegistrations[wafName].register()
+	}
+	config.wafMaps = &atomic.Pointer[wafMaps]{}
+	config.wafMaps.Store(&wafs)
+	if hasRulesDir {
+		rulesWatcher, err := newRulesWatcher(rulesDir, rulesDirPollInterval, rootFS, config.directives, config.wafMaps)
+		if err != nil {
+			return nil, err
+		}
+		config.rulesWatcher = rulesWatcher
 	}
 	return &config, nil
 }
 
+func newWAF(rootFS fs.FS, rules Directives) (coraza.WAF, error) {
+	directives := rules.SimpleDirectives
+	if rules.AuditLog != nil {
+		auditLogDirectives, err := auditLogDirectives(rules.AuditLog)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(append([]string(nil), directives...), auditLogDirectives...)
+	}
+	wafConfig := coraza.NewWAFConfig().WithErrorCallback(errorCallback).WithRootFS(rootFS).WithDirectives(strings.Join(directives, "\n"))
+	return coraza.NewWAF(wafConfig)
+}
+
+// configErrors gathers every error found in the plugin config, so that they can be fixed at once
+type configErrors []error
+
+func (e configErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isRouteConfig reports whether the plugin config only carries per-route override keys
+func isRouteConfig(v map[string]interface{}) bool {
+	_, hasDirective := v["directive"]
+	_, hasRuleEngine := v["rule_engine"]
+	return hasDirective || hasRuleEngine
+}
+
+func parseRouteConfig(v map[string]interface{}) (*routeConfiguration, error) {
+	var config routeConfiguration
+	if directive, ok := v["directive"]; ok {
+		directiveString, ok := directive.(string)
+		if !ok || len(directiveString) == 0 {
+			return nil, errors.New("directive must be a non-empty string")
+		}
+		config.directive = directiveString
+	}
+	if ruleEngine, ok := v["rule_engine"]; ok {
+		ruleEngineString, ok := ruleEngine.(string)
+		if !ok {
+			return nil, errors.New("rule_engine must be a string")
+		}
+		ruleEngineStatus, err := ctypes.ParseRuleEngineStatus(ruleEngineString)
+		if err != nil {
+			return nil, err
+		}
+		config.ruleEngine = &ruleEngineStatus
+	}
+	return &config, nil
+}
+
+// Merge merges the per-route configuration on top of the listener one. Envoy gives Merge no way to fail, an
+// unexpected configuration is merged into an error which configFactory turns into rejected requests.
 func (p parser) Merge(parentConfig interface{}, childConfig interface{}) interface{} {
-	panic("TODO")
+	parent, ok := parentConfig.(*configuration)
+	if !ok {
+		if err, ok := parentConfig.(error); ok {
+			return err
+		}
+		err := errors.New(fmt.Sprintf("unexpected parent config type %T", parentConfig))
+		api.LogError(BuildLoggerMessage().err(err).msg("Failed to merge the per-route configuration"))
+		return err
+	}
+	switch child := childConfig.(type) {
+	case *configuration:
+		// a complete configuration on the route replaces the listener one
+		return child
+	case *routeConfiguration:
+		merged := *parent
+		if len(child.directive) != 0 {
+			if _, ok := parent.directives[child.directive]; ok {
+				merged.defaultDirective = child.directive
+				// the route already scopes the virtual host and path, so the host and route mappings no longer apply
+				merged.hostDirectiveMap = nil
+				merged.hostMatcher = nil
+				merged.routeMatcher = nil
+			} else {
+				api.LogError(BuildLoggerMessage().str("directive", child.directive).msg("Route directive does not exist, keep the listener configuration"))
+			}
+		}
+		if child.ruleEngine != nil {
+			merged.ruleEngine = *child.ruleEngine
+		}
+		return &merged
+	default:
+		err := errors.New(fmt.Sprintf("unexpected child config type %T", childConfig))
+		api.LogError(BuildLoggerMessage().err(err).msg("Failed to merge the per-route configuration"))
+		return err
+	}
 }
 
 func errorCallback(error ctypes.MatchedRule) {
-	msg := error.ErrorLog(error.Rule().ID())
+	msg := BuildLoggerMessage().
+		str("transaction_id", error.TransactionID()).
+		str("client_ip", error.ClientIPAddress()).
+		int("rule", error.Rule().ID()).
+		msg(error.ErrorLog(error.Rule().ID()))
 	switch error.Rule().Severity() {
 	case ctypes.RuleSeverityEmergency:
 		api.LogCritical(msg)
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	ctypes "github.com/corazawaf/coraza/v3/types"
+	"testing"
+)
+
+func TestParseRouteConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     map[string]interface{}
+		directive  string
+		ruleEngine string
+		ok         bool
+	}{
+		{"directive", map[string]interface{}{"directive": "strict"}, "strict", "", true},
+		{"rule_engine", map[string]interface{}{"rule_engine": "DetectionOnly"}, "", "DetectionOnly", true},
+		{"both", map[string]interface{}{"directive": "strict", "rule_engine": "Off"}, "strict", "Off", true},
+		{"empty directive", map[string]interface{}{"directive": ""}, "", "", false},
+		{"directive not a string", map[string]interface{}{"directive": 1.0}, "", "", false},
+		{"rule_engine not a string", map[string]interface{}{"rule_engine": true}, "", "", false},
+		{"unknown rule_engine", map[string]interface{}{"rule_engine": "Sometimes"}, "", "", false},
+	}
+	for _, test := range tests {
+		got, err := parseRouteConfig(test.config)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: parseRouteConfig = %v", test.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		ruleEngine := ""
+		if got.ruleEngine != nil {
+			ruleEngine = got.ruleEngine.String()
+		}
+		if got.directive != test.directive || ruleEngine != test.ruleEngine {
+			t.Errorf("%s: parseRouteConfig = %q, %q, want %q, %q", test.name, got.directive, ruleEngine, test.directive, test.ruleEngine)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	hostMatcher, err := newHostMatcher(HostDirectiveMap{"foo.example.com": "strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeMatcher, err := newRouteMatcher(RouteDirectiveMap{{PathPrefix: "/admin", Directive: "strict"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := &configuration{
+		directives:       WafDirectives{"default": {}, "strict": {}, "lax": {}},
+		defaultDirective: "default",
+		hostDirectiveMap: HostDirectiveMap{"foo.example.com": "strict"},
+		hostMatcher:      hostMatcher,
+		routeMatcher:     routeMatcher,
+		ruleEngine:       ctypes.RuleEngineOn,
+	}
+	detectionOnly := ctypes.RuleEngineDetectionOnly
+	tests := []struct {
+		name       string
+		child      interface{}
+		directive  string
+		ruleEngine ctypes.RuleEngineStatus
+		// mapped reports whether the host and route mappings of the listener still apply
+		mapped bool
+	}{
+		// the route directive takes precedence over the host and route mappings of the listener
+		{"directive", &routeConfiguration{directive: "lax"}, "lax", ctypes.RuleEngineOn, false},
+		{"rule_engine", &routeConfiguration{ruleEngine: &detectionOnly}, "default", ctypes.RuleEngineDetectionOnly, true},
+		{"both", &routeConfiguration{directive: "lax", ruleEngine: &detectionOnly}, "lax", ctypes.RuleEngineDetectionOnly, false},
+		// an unknown directive keeps the listener configuration
+		{"unknown directive", &routeConfiguration{directive: "missing"}, "default", ctypes.RuleEngineOn, true},
+		{"empty", &routeConfiguration{}, "default", ctypes.RuleEngineOn, true},
+	}
+	p := parser{}
+	for _, test := range tests {
+		merged, ok := p.Merge(parent, test.child).(*configuration)
+		if !ok {
+			t.Errorf("%s: Merge is not a configuration", test.name)
+			continue
+		}
+		if merged == parent {
+			t.Errorf("%s: Merge modified the listener configuration", test.name)
+			continue
+		}
+		mapped := merged.hostMatcher != nil && merged.routeMatcher != nil && merged.hostDirectiveMap != nil
+		if merged.defaultDirective != test.directive || merged.ruleEngine != test.ruleEngine || mapped != test.mapped {
+			t.Errorf("%s: Merge = %q, %s, %v, want %q, %s, %v", test.name, merged.defaultDirective, merged.ruleEngine, mapped, test.directive, test.ruleEngine, test.mapped)
+		}
+		if got := merged.directive("foo.example.com", "/admin", "GET"); (test.mapped && got != "strict") || (!test.mapped && got != test.directive) {
+			t.Errorf("%s: merged directive = %q", test.name, got)
+		}
+	}
+	if parent.defaultDirective != "default" || parent.ruleEngine != ctypes.RuleEngineOn || parent.hostMatcher == nil {
+		t.Error("Merge modified the listener configuration")
+	}
+	// a complete configuration on the route replaces the listener one
+	child := &configuration{defaultDirective: "lax"}
+	if got := p.Merge(parent, child); got != child {
+		t.Errorf("Merge = %v, want the route configuration", got)
+	}
+}
+
+func TestMergeErrors(t *testing.T) {
+	parent := &configuration{directives: WafDirectives{"default": {}}, defaultDirective: "default"}
+	parseErr := errors.New("invalid configuration")
+	tests := []struct {
+		name   string
+		parent interface{}
+		child  interface{}
+		want   string
+	}{
+		// the error of the listener configuration is kept
+		{"parent error", parseErr, &routeConfiguration{directive: "default"}, "invalid configuration"},
+		{"parent type", "default", &routeConfiguration{}, "unexpected parent config type string"},
+		{"child type", parent, map[string]interface{}{"directive": "default"}, "unexpected child config type map[string]interface {}"},
+		{"nil child", parent, nil, "unexpected child config type <nil>"},
+	}
+	p := parser{}
+	for _, test := range tests {
+		err, ok := p.Merge(test.parent, test.child).(error)
+		if !ok {
+			t.Errorf("%s: Merge is not an error", test.name)
+			continue
+		}
+		if err.Error() != test.want {
+			t.Errorf("%s: Merge error %q, want %q", test.name, err.Error(), test.want)
+		}
+	}
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/corazawaf/coraza/v3/experimental/plugins"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/macro"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCollectionTimeout          = time.Hour
+	defaultCollectionMaxRecords       = 100000
+	defaultCollectionSnapshotInterval = time.Minute
+	collectionStoreShards             = 64
+
+	// collectionStoreKey and collectionsKey are the TX variables binding the transaction to the store of its
+	// directive set and listing the collections loaded by initcol
+	collectionStoreKey = "waf_go_envoy_collection_store"
+	collectionsKey     = "waf_go_envoy_collections"
+	// collectionAssignedPrefix marks the variables assigned or removed by setvar, they overwrite the stored ones,
+	// collectionDeltaPrefix keeps the sum of the increments of the other ones, which are added to the stored ones
+	collectionAssignedPrefix = "waf_go_envoy_assigned."
+	collectionDeltaPrefix    = "waf_go_envoy_delta."
+
+	// the variables of a collection which are not stored
+	collectionVariableKey     = "key"
+	collectionVariableIsNew   = "is_new"
+	collectionVariableCreated = "create_time"
+)
+
+// persistentCollections are the collections initcol loads from the store, their variables are kept in TX
+// prefixed with the collection name, e.g. setvar:ip.score=+5 sets TX:ip.score
+var persistentCollections = map[string]*regexp.Regexp{
+	"global":   regexp.MustCompile(`^global\.`),
+	"ip":       regexp.MustCompile(`^ip\.`),
+	"resource": regexp.MustCompile(`^resource\.`),
+	"session":  regexp.MustCompile(`^session\.`),
+	"user":     regexp.MustCompile(`^user\.`),
+}
+
+var (
+	collectionAssignedRegexp = regexp.MustCompile("^" + regexp.QuoteMeta(collectionAssignedPrefix))
+	collectionDeltaRegexp    = regexp.MustCompile("^" + regexp.QuoteMeta(collectionDeltaPrefix))
+)
+
+// initcol and setvar replace the ones of Coraza, whose initcol is a no-op and whose setvar only sets TX
+func init() {
+	plugins.RegisterAction("initcol", func() plugintypes.Action {
+		return &initcolAction{}
+	})
+	plugins.RegisterAction("setvar", func() plugintypes.Action {
+		return &setvarAction{}
+	})
+}
+
+// PersistentCollections configures the store of the persistent collections of a directive set
+type PersistentCollections struct {
+	// Timeout is the time a record is kept after its last update, 1h by default
+	Timeout string `json:"timeout"`
+	// MaxRecords bounds the records of the store, the records expiring first are evicted over it
+	MaxRecords int `json:"max_records"`
+	// SnapshotPath is the file the store is saved to every SnapshotInterval and loaded from, e.g. across hot restarts
+	SnapshotPath     string `json:"snapshot_path"`
+	SnapshotInterval string `json:"snapshot_interval"`
+}
+
+// collectionRecord is a persistent collection, e.g. the IP collection of a client
+type collectionRecord struct {
+	Values  map[string]string `json:"values"`
+	Created time.Time         `json:"created"`
+	Expires time.Time         `json:"expires"`
+}
+
+type collectionShard struct {
+	mu      sync.Mutex
+	records map[string]*collectionRecord
+}
+
+// collectionSettings are the settings of a store, the ones of the last configuration registering it apply
+type collectionSettings struct {
+	timeout          time.Duration
+	maxShardRecords  int
+	snapshotInterval time.Duration
+}
+
+// collectionStore is the in-memory store of the persistent collections of a directive set, sharded by record
+type collectionStore struct {
+	key          string
+	name         string
+	snapshotPath string
+	settings     atomic.Pointer[collectionSettings]
+	shards       [collectionStoreShards]collectionShard
+	// refs counts the handles of the configurations using the store, guarded by collectionStores
+	refs int
+	stop chan struct{}
+	// done is closed once the goroutine of the store saved its last snapshot
+	done chan struct{}
+}
+
+// collectionStores holds the stores by key, a store is kept across config updates and rules reloads as long as a
+// configuration uses it. The stores are keyed by snapshot_path, so that a file has a single writer, or by
+// directive set name without snapshot. released holds the stores saving their last snapshot.
+var collectionStores = struct {
+	sync.Mutex
+	stores   map[string]*collectionStore
+	released map[string]*collectionStore
+}{stores: make(map[string]*collectionStore), released: make(map[string]*collectionStore)}
+
+// collectionStoreHandle is referenced by the configuration, the store is released once the configurations
+// using it, and therefore their handles, are garbage collected
+type collectionStoreHandle struct {
+	store *collectionStore
+}
+
+// collectionStoreRegistration is the validated store of a directive set, it is registered once the configuration
+// is accepted
+type collectionStoreRegistration struct {
+	key          string
+	name         string
+	snapshotPath string
+	settings     *collectionSettings
+}
+
+// prepareCollectionStore validates the config of the store of the directive set, without touching the registered stores
+func prepareCollectionStore(name string, config *PersistentCollections) (*collectionStoreRegistration, error) {
+	settings, err := newCollectionSettings(config)
+	if err != nil {
+		return nil, err
+	}
+	key := "directive:" + name
+	if len(config.SnapshotPath) != 0 {
+		key = "snapshot:" + filepath.Clean(config.SnapshotPath)
+	}
+	return &collectionStoreRegistration{key: key, name: name, snapshotPath: config.SnapshotPath, settings: settings}, nil
+}
+
+// register returns the handle of the store of the directive set, the filter sets its key in TX. The settings of
+// the registration apply to a store already registered.
+func (r *collectionStoreRegistration) register() *collectionStoreHandle {
+	if lintOnly {
+		store := &collectionStore{key: r.key, name: r.name, snapshotPath: r.snapshotPath}
+		store.settings.Store(r.settings)
+		return &collectionStoreHandle{store: store}
+	}
+	collectionStores.Lock()
+	defer collectionStores.Unlock()
+	store, ok := collectionStores.stores[r.key]
+	for !ok {
+		released, saving := collectionStores.released[r.key]
+		if !saving {
+			store = newCollectionStore(r.key, r.name, r.snapshotPath, r.settings)
+			collectionStores.stores[r.key] = store
+			go store.run()
+			break
+		}
+		// the new store loads the last snapshot of the released one
+		collectionStores.Unlock()
+		<-released.done
+		collectionStores.Lock()
+		store, ok = collectionStores.stores[r.key]
+	}
+	if ok {
+		store.settings.Store(r.settings)
+	}
+	store.refs++
+	handle := &collectionStoreHandle{store: store}
+	runtime.SetFinalizer(handle, func(h *collectionStoreHandle) {
+		h.store.release()
+	})
+	return handle
+}
+
+// release stops the store once no configuration uses it, its goroutine saves the last snapshot
+func (s *collectionStore) release() {
+	collectionStores.Lock()
+	defer collectionStores.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return
+	}
+	delete(collectionStores.stores, s.key)
+	collectionStores.released[s.key] = s
+	close(s.stop)
+}
+
+func lookupCollectionStore(key string) (*collectionStore, bool) {
+	collectionStores.Lock()
+	defer collectionStores.Unlock()
+	store, ok := collectionStores.stores[key]
+	return store, ok
+}
+
+func newCollectionSettings(config *PersistentCollections) (*collectionSettings, error) {
+	timeout, err := parseCollectionDuration("timeout", config.Timeout, defaultCollectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	snapshotInterval, err := parseCollectionDuration("snapshot_interval", config.SnapshotInterval, defaultCollectionSnapshotInterval)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxRecords < 0 {
+		return nil, errors.New("persistent_collections max_records must not be negative")
+	}
+	maxRecords := config.MaxRecords
+	if maxRecords == 0 {
+		maxRecords = defaultCollectionMaxRecords
+	}
+	return &collectionSettings{
+		timeout:          timeout,
+		maxShardRecords:  (maxRecords + collectionStoreShards - 1) / collectionStoreShards,
+		snapshotInterval: snapshotInterval,
+	}, nil
+}
+
+func newCollectionStore(key, name, snapshotPath string, settings *collectionSettings) *collectionStore {
+	s := &collectionStore{
+		key:          key,
+		name:         name,
+		snapshotPath: snapshotPath,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	s.settings.Store(settings)
+	for i := range s.shards {
+		s.shards[i].records = make(map[string]*collectionRecord)
+	}
+	if len(s.snapshotPath) != 0 {
+		if err := s.load(); err != nil {
+			api.LogError(BuildLoggerMessage().str("directive", name).str("snapshot_path", s.snapshotPath).err(err).msg("Failed to load persistent collections snapshot"))
+		}
+	}
+	return s
+}
+
+func parseCollectionDuration(key, value string, defaultValue time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.New(fmt.Sprintf("persistent_collections %s %s is not a positive duration", key, value))
+	}
+	return d, nil
+}
+
+func (s *collectionStore) shard(id string) *collectionShard {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return &s.shards[h.Sum32()%collectionStoreShards]
+}
+
+// get returns a copy of the record, nil when it does not exist or expired
+func (s *collectionStore) get(id string) *collectionRecord {
+	shard := s.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	record, ok := shard.records[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(record.Expires) {
+		delete(shard.records, id)
+		return nil
+	}
+	values := make(map[string]string, len(record.Values))
+	for name, value := range record.Values {
+		values[name] = value
+	}
+	return &collectionRecord{Values: values, Created: record.Created, Expires: record.Expires}
+}
+
+// update applies the changes of a transaction to the record: values are the variables of the collection at the
+// end of the transaction, the assigned ones overwrite the stored ones, or remove them when they are no longer set,
+// and the deltas of the other ones are added to the stored ones, so that the concurrent transactions of a client
+// add up.
+func (s *collectionStore) update(id string, values map[string]string, assigned map[string]bool, deltas map[string]int) {
+	if len(assigned) == 0 && len(deltas) == 0 {
+		return
+	}
+	shard := s.shard(id)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	now := time.Now()
+	record, ok := shard.records[id]
+	if !ok || now.After(record.Expires) {
+		record = &collectionRecord{Values: make(map[string]string), Created: now}
+	}
+	for name := range assigned {
+		if value, ok := values[name]; ok {
+			record.Values[name] = value
+		} else {
+			delete(record.Values, name)
+		}
+	}
+	for name, delta := range deltas {
+		if assigned[name] {
+			continue
+		}
+		current, err := strconv.Atoi(record.Values[name])
+		if err != nil && len(record.Values[name]) != 0 {
+			// the stored value is no longer a number, the one of the transaction wins
+			record.Values[name] = values[name]
+			continue
+		}
+		record.Values[name] = strconv.Itoa(current + delta)
+	}
+	if len(record.Values) == 0 {
+		delete(shard.records, id)
+		return
+	}
+	record.Expires = now.Add(s.settings.Load().timeout)
+	if _, ok := shard.records[id]; !ok {
+		s.evict(shard, now)
+	}
+	shard.records[id] = record
+}
+
+// evict makes room for a record in a full shard, the expired records first, then the one expiring first
+func (s *collectionStore) evict(shard *collectionShard, now time.Time) {
+	maxShardRecords := s.settings.Load().maxShardRecords
+	if len(shard.records) < maxShardRecords {
+		return
+	}
+	var first string
+	var firstExpires time.Time
+	for id, record := range shard.records {
+		if now.After(record.Expires) {
+			delete(shard.records, id)
+			continue
+		}
+		if len(first) == 0 || record.Expires.Before(firstExpires) {
+			first, firstExpires = id, record.Expires
+		}
+	}
+	if len(shard.records) >= maxShardRecords {
+		delete(shard.records, first)
+	}
+}
+
+// run removes the expired records and saves the snapshot every snapshot_interval, until the store is released
+// and its last snapshot saved
+func (s *collectionStore) run() {
+	defer func() {
+		collectionStores.Lock()
+		if collectionStores.released[s.key] == s {
+			delete(collectionStores.released, s.key)
+		}
+		collectionStores.Unlock()
+		close(s.done)
+	}()
+	for {
+		timer := time.NewTimer(s.settings.Load().snapshotInterval)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			s.snapshot()
+			return
+		case <-timer.C:
+			s.snapshot()
+		}
+	}
+}
+
+// snapshot removes the expired records and saves the others to snapshot_path
+func (s *collectionStore) snapshot() {
+	snapshot := s.sweep()
+	if len(s.snapshotPath) == 0 {
+		return
+	}
+	if err := s.save(snapshot); err != nil {
+		api.LogError(BuildLoggerMessage().str("directive", s.name).str("snapshot_path", s.snapshotPath).err(err).msg("Failed to save persistent collections snapshot"))
+	}
+}
+
+// sweep removes the expired records and returns the others
+func (s *collectionStore) sweep() map[string]collectionRecord {
+	now := time.Now()
+	snapshot := make(map[string]collectionRecord)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mu.Lock()
+		for id, record := range shard.records {
+			if now.After(record.Expires) {
+				delete(shard.records, id)
+				continue
+			}
+			snapshot[id] = *record
+		}
+		shard.mu.Unlock()
+	}
+	return snapshot
+}
+
+// save writes the snapshot to a temporary file renamed over snapshot_path, so that a crash never leaves it truncated
+func (s *collectionStore) save(snapshot map[string]collectionRecord) error {
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.snapshotPath), 0755); err != nil {
+		return err
+	}
+	tmp := s.snapshotPath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.snapshotPath)
+}
+
+func (s *collectionStore) load() error {
+	b, err := os.ReadFile(s.snapshotPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot map[string]*collectionRecord
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return err
+	}
+	now := time.Now()
+	for id, record := range snapshot {
+		if record == nil || now.After(record.Expires) || record.Values == nil {
+			continue
+		}
+		shard := s.shard(id)
+		s.evict(shard, now)
+		shard.records[id] = record
+	}
+	return nil
+}
+
+// bindCollectionStore binds the transaction to the store of its directive set, initcol is a no-op without it
+func (f *filter) bindCollectionStore() {
+	handle, ok := f.conf.collectionStores[f.directive]
+	if !ok {
+		return
+	}
+	if state, ok := f.tx.(plugintypes.TransactionState); ok {
+		state.Variables().TX().Set(collectionStoreKey, []string{handle.store.key})
+	}
+}
+
+// initcolAction loads a persistent collection from the store of the directive set, e.g. initcol:ip=%{REMOTE_ADDR}
+type initcolAction struct {
+	collection string
+	key        macro.Macro
+}
+
+func (a *initcolAction) Init(_ plugintypes.RuleMetadata, data string) error {
+	col, key, ok := strings.Cut(data, "=")
+	if !ok || len(key) == 0 {
+		return errors.New("invalid arguments, expected syntax initcol:{collection}={key}")
+	}
+	col = strings.ToLower(col)
+	if _, ok := persistentCollections[col]; !ok {
+		return errors.New(fmt.Sprintf("initcol collection %s is not supported", col))
+	}
+	m, err := macro.NewMacro(key)
+	if err != nil {
+		return err
+	}
+	a.collection = col
+	a.key = m
+	return nil
+}
+
+func (a *initcolAction) Evaluate(_ plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	txCollection := tx.Variables().TX()
+	storeKey := txCollection.Get(collectionStoreKey)
+	if len(storeKey) == 0 {
+		return
+	}
+	store, ok := lookupCollectionStore(storeKey[0])
+	if !ok {
+		return
+	}
+	for _, initialized := range txCollection.Get(collectionsKey) {
+		if col, _, _ := strings.Cut(initialized, "="); col == a.collection {
+			return
+		}
+	}
+	key := a.key.Expand(tx)
+	id := a.collection + "=" + key
+	txCollection.Add(collectionsKey, id)
+	prefix := a.collection + "."
+	txCollection.Set(prefix+collectionVariableKey, []string{key})
+	record := store.get(id)
+	if record == nil {
+		txCollection.Set(prefix+collectionVariableIsNew, []string{"1"})
+		txCollection.Set(prefix+collectionVariableCreated, []string{strconv.FormatInt(time.Now().Unix(), 10)})
+		return
+	}
+	txCollection.Set(prefix+collectionVariableIsNew, []string{"0"})
+	txCollection.Set(prefix+collectionVariableCreated, []string{strconv.FormatInt(record.Created.Unix(), 10)})
+	for name, value := range record.Values {
+		txCollection.Set(prefix+name, []string{value})
+	}
+}
+
+func (a *initcolAction) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// persistCollections saves the collections loaded by the transaction to the store of the directive set
+func (f *filter) persistCollections() {
+	state, ok := f.tx.(plugintypes.TransactionState)
+	if !ok {
+		return
+	}
+	txCollection := state.Variables().TX()
+	storeKey := txCollection.Get(collectionStoreKey)
+	if len(storeKey) == 0 {
+		return
+	}
+	store, ok := lookupCollectionStore(storeKey[0])
+	if !ok {
+		return
+	}
+	for _, id := range txCollection.Get(collectionsKey) {
+		col, _, _ := strings.Cut(id, "=")
+		prefix := col + "."
+		values := make(map[string]string)
+		for _, matchData := range txCollection.FindRegex(persistentCollections[col]) {
+			name := strings.TrimPrefix(matchData.Key(), prefix)
+			switch name {
+			case collectionVariableKey, collectionVariableIsNew, collectionVariableCreated:
+				continue
+			}
+			values[name] = matchData.Value()
+		}
+		assigned := make(map[string]bool)
+		for _, matchData := range txCollection.FindRegex(collectionAssignedRegexp) {
+			if name := strings.TrimPrefix(matchData.Key(), collectionAssignedPrefix); strings.HasPrefix(name, prefix) {
+				assigned[strings.TrimPrefix(name, prefix)] = true
+			}
+		}
+		deltas := make(map[string]int)
+		for _, matchData := range txCollection.FindRegex(collectionDeltaRegexp) {
+			if name := strings.TrimPrefix(matchData.Key(), collectionDeltaPrefix); strings.HasPrefix(name, prefix) {
+				if delta, err := strconv.Atoi(matchData.Value()); err == nil {
+					deltas[strings.TrimPrefix(name, prefix)] = delta
+				}
+			}
+		}
+		store.update(id, values, assigned, deltas)
+	}
+}
+
+// setvarAction sets a TX variable like the setvar of Coraza, or a variable of a persistent collection, kept in TX:
+//
+//	setvar:ip.score=+5 increments TX:ip.score, the increment is added to the stored value
+//	setvar:ip.blocked=1 sets TX:ip.blocked, the value overwrites the stored one
+//	setvar:!ip.score removes TX:ip.score and the stored value
+type setvarAction struct {
+	// collection is empty for TX
+	collection string
+	key        macro.Macro
+	value      macro.Macro
+	isRemove   bool
+}
+
+func (a *setvarAction) Init(_ plugintypes.RuleMetadata, data string) error {
+	if len(data) == 0 {
+		return errors.New("missing arguments")
+	}
+	if data[0] == '!' {
+		a.isRemove = true
+		data = data[1:]
+	}
+	key, val, valOk := strings.Cut(data, "=")
+	col, name, _ := strings.Cut(key, ".")
+	col = strings.ToLower(col)
+	if _, ok := persistentCollections[col]; !ok && col != "tx" {
+		return errors.New("invalid arguments, expected collection TX, GLOBAL, IP, RESOURCE, SESSION or USER")
+	}
+	if strings.TrimSpace(name) == "" {
+		return errors.New("invalid arguments, expected syntax {collection}.{key}={value}")
+	}
+	m, err := macro.NewMacro(name)
+	if err != nil {
+		return err
+	}
+	if col != "tx" {
+		a.collection = col
+	}
+	a.key = m
+	if valOk {
+		m, err := macro.NewMacro(val)
+		if err != nil {
+			return err
+		}
+		a.value = m
+	}
+	return nil
+}
+
+func (a *setvarAction) Evaluate(r plugintypes.RuleMetadata, tx plugintypes.TransactionState) {
+	key := strings.ToLower(a.key.Expand(tx))
+	if len(a.collection) != 0 {
+		key = a.collection + "." + key
+	}
+	value := ""
+	if a.value != nil {
+		value = a.value.Expand(tx)
+	}
+	tx.DebugLogger().Debug().
+		Str("var_key", key).
+		Str("var_value", value).
+		Int("rule_id", r.ID()).
+		Msg("Action evaluated")
+	if len(a.collection) == 0 {
+		setTXVariable(r, tx, key, value, a.isRemove)
+		return
+	}
+	txCollection := tx.Variables().TX()
+	if a.isRemove {
+		txCollection.Remove(key)
+		txCollection.Set(collectionAssignedPrefix+key, []string{"1"})
+		return
+	}
+	if len(value) == 0 || (value[0] != '+' && value[0] != '-') {
+		txCollection.Set(key, []string{value})
+		txCollection.Set(collectionAssignedPrefix+key, []string{"1"})
+		return
+	}
+	increment := 0
+	if len(value) > 1 {
+		var err error
+		if increment, err = strconv.Atoi(value[1:]); err != nil {
+			tx.DebugLogger().Error().Str("var_value", value).Int("rule_id", r.ID()).Err(err).Msg("Invalid value")
+			return
+		}
+	}
+	if value[0] == '-' {
+		increment = -increment
+	}
+	current := 0
+	if values := txCollection.Get(key); len(values) != 0 && len(values[0]) != 0 {
+		var err error
+		if current, err = strconv.Atoi(values[0]); err != nil {
+			tx.DebugLogger().Error().Str("var_key", key).Int("rule_id", r.ID()).Err(err).Msg("Invalid value")
+			return
+		}
+	}
+	txCollection.Set(key, []string{strconv.Itoa(current + increment)})
+	if len(txCollection.Get(collectionAssignedPrefix+key)) == 0 {
+		delta := 0
+		if values := txCollection.Get(collectionDeltaPrefix + key); len(values) != 0 {
+			delta, _ = strconv.Atoi(values[0])
+		}
+		txCollection.Set(collectionDeltaPrefix+key, []string{strconv.Itoa(delta + increment)})
+	}
+}
+
+func (a *setvarAction) Type() plugintypes.ActionType {
+	return plugintypes.ActionTypeNondisruptive
+}
+
+// setTXVariable sets a TX variable as the setvar of Coraza does, e.g. a decrement of an unset variable is a no-op
+func setTXVariable(r plugintypes.RuleMetadata, tx plugintypes.TransactionState, key, value string, isRemove bool) {
+	txCollection := tx.Variables().TX()
+	if isRemove {
+		txCollection.Remove(key)
+		return
+	}
+	current := ""
+	if values := txCollection.Get(key); len(values) != 0 {
+		current = values[0]
+	}
+	switch {
+	case len(value) == 0:
+		txCollection.Set(key, []string{""})
+	case value[0] == '+':
+		sum := 0
+		if len(value) > 1 {
+			var err error
+			if sum, err = strconv.Atoi(value[1:]); err != nil {
+				tx.DebugLogger().Error().Str("var_value", value).Int("rule_id", r.ID()).Err(err).Msg("Invalid value")
+				return
+			}
+		}
+		n := 0
+		if len(current) != 0 {
+			var err error
+			if n, err = strconv.Atoi(current); err != nil {
+				tx.DebugLogger().Error().Str("var_key", current).Int("rule_id", r.ID()).Err(err).Msg("Invalid value")
+				return
+			}
+		}
+		txCollection.Set(key, []string{strconv.Itoa(sum + n)})
+	case value[0] == '-':
+		decrement, _ := strconv.Atoi(value[1:])
+		n, err := strconv.Atoi(current)
+		if err != nil {
+			return
+		}
+		txCollection.Set(key, []string{strconv.Itoa(n - decrement)})
+	default:
+		txCollection.Set(key, []string{value})
+	}
+}
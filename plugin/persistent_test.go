@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/experimental/plugins/plugintypes"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// runCollectionTransactions runs the transactions concurrently: they all load the record before any is persisted
+func runCollectionTransactions(t *testing.T, handle *collectionStoreHandle, rules string, n int) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := make([]*filter, 0, n)
+	for i := 0; i < n; i++ {
+		f := &filter{tx: waf.NewTransaction()}
+		f.tx.(plugintypes.TransactionState).Variables().TX().Set(collectionStoreKey, []string{handle.store.key})
+		f.tx.ProcessConnection("10.0.0.1", 1234, "10.0.0.2", 80)
+		f.tx.ProcessURI("/login", "POST", "HTTP/1.1")
+		f.tx.ProcessRequestHeaders()
+		filters = append(filters, f)
+	}
+	for _, f := range filters {
+		f.persistCollections()
+		_ = f.tx.Close()
+	}
+}
+
+// registerTestCollectionStore registers the store, its handle is released by hand, not by its finalizer
+func registerTestCollectionStore(t *testing.T, name string, config *PersistentCollections) *collectionStoreHandle {
+	registration, err := prepareCollectionStore(name, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := registration.register()
+	runtime.SetFinalizer(handle, nil)
+	return handle
+}
+
+func TestCollectionStoreMerge(t *testing.T) {
+	// a snapshot_path of its own gives the test a new store
+	handle := registerTestCollectionStore(t, "merge", &PersistentCollections{SnapshotPath: filepath.Join(t.TempDir(), "collections.json")})
+	rules := `SecAction "id:1,phase:1,nolog,pass,initcol:ip=%{REMOTE_ADDR}"
+SecAction "id:2,phase:1,nolog,pass,setvar:ip.attempts=+1,setvar:ip.blocked=5,setvar:ip.score=+10,setvar:ip.score=3"`
+	runCollectionTransactions(t, handle, rules, 2)
+	record := handle.store.get("ip=10.0.0.1")
+	if record == nil {
+		t.Fatal("record not stored")
+	}
+	want := map[string]string{
+		// the increments of the concurrent transactions add up
+		"attempts": "2",
+		// the assignments overwrite
+		"blocked": "5",
+		"score":   "3",
+	}
+	for name, value := range want {
+		if got := record.Values[name]; got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	runCollectionTransactions(t, handle, `SecAction "id:1,phase:1,nolog,pass,initcol:ip=%{REMOTE_ADDR}"
+SecAction "id:2,phase:1,nolog,pass,setvar:ip.attempts=-1,setvar:!ip.blocked"`, 1)
+	record = handle.store.get("ip=10.0.0.1")
+	if got := record.Values["attempts"]; got != "1" {
+		t.Errorf("attempts = %q, want 1", got)
+	}
+	if _, ok := record.Values["blocked"]; ok {
+		t.Error("blocked not removed")
+	}
+}
+
+func TestCollectionStoreSharedBySnapshotPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collections.json")
+	first := registerTestCollectionStore(t, "waf1", &PersistentCollections{SnapshotPath: path})
+	// a prepared store is only registered once the configuration is accepted
+	if _, err := prepareCollectionStore("waf1", &PersistentCollections{SnapshotPath: path, Timeout: "10m"}); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := first.store.settings.Load().timeout; timeout != defaultCollectionTimeout {
+		t.Errorf("timeout = %s, the settings of a prepared store apply", timeout)
+	}
+	second := registerTestCollectionStore(t, "waf1", &PersistentCollections{SnapshotPath: path, Timeout: "5m"})
+	if first.store != second.store {
+		t.Fatal("a snapshot_path has more than one store")
+	}
+	if timeout := second.store.settings.Load().timeout.String(); timeout != "5m0s" {
+		t.Errorf("timeout = %s, the settings of the last configuration do not apply", timeout)
+	}
+	store := first.store
+	store.update("ip=10.0.0.1", map[string]string{"score": "5"}, map[string]bool{"score": true}, nil)
+	store.release()
+	if _, ok := lookupCollectionStore(store.key); !ok {
+		t.Fatal("store released while a configuration uses it")
+	}
+	store.release()
+	if _, ok := lookupCollectionStore(store.key); ok {
+		t.Fatal("store not released")
+	}
+	// a store registered again for the path loads the last snapshot of the released one
+	third := registerTestCollectionStore(t, "waf2", &PersistentCollections{SnapshotPath: path})
+	select {
+	case <-store.done:
+	default:
+		t.Fatal("the released store is reused before its last snapshot is saved")
+	}
+	if third.store == store {
+		t.Fatal("the released store is reused")
+	}
+	if record := third.store.get("ip=10.0.0.1"); record == nil || record.Values["score"] != "5" {
+		t.Errorf("record = %+v, the last snapshot is not loaded", record)
+	}
+	third.store.release()
+	<-third.store.done
+}
+
+func TestSetvarAction(t *testing.T) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(`SecAction "id:1,phase:1,nolog,pass,setvar:tx.score=+5,setvar:tx.score=+2,setvar:tx.unset=-1,setvar:tx.name=%{REQUEST_METHOD},setvar:tx.removed=1,setvar:!tx.removed"
+SecAction "id:2,phase:1,nolog,pass,setvar:ip.attempts=+1,setvar:ip.attempts=+1"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := waf.NewTransaction()
+	defer tx.Close()
+	tx.ProcessURI("/", "POST", "HTTP/1.1")
+	tx.ProcessRequestHeaders()
+	txCollection := tx.(plugintypes.TransactionState).Variables().TX()
+	want := map[string][]string{
+		"score": {"7"},
+		// a decrement of an unset TX variable is a no-op, as with the setvar of Coraza
+		"unset":   nil,
+		"name":    {"POST"},
+		"removed": nil,
+		// the variables of a collection are kept in TX, with the sum of their increments
+		"ip.attempts":                         {"2"},
+		collectionDeltaPrefix + "ip.attempts": {"2"},
+	}
+	for key, value := range want {
+		if got := txCollection.Get(key); !reflect.DeepEqual(got, value) {
+			t.Errorf("TX:%s = %q, want %q", key, got, value)
+		}
+	}
+	for _, rule := range []string{
+		`SecAction "id:1,phase:1,nolog,pass,setvar:geo.score=1"`,
+		`SecAction "id:1,phase:1,nolog,pass,setvar:ip.=1"`,
+		`SecAction "id:1,phase:1,nolog,pass,initcol:geo=%{REMOTE_ADDR}"`,
+	} {
+		if _, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives(rule)); err == nil {
+			t.Errorf("%s accepted", rule)
+		}
+	}
+}
+
+func TestCollectionSettingsErrors(t *testing.T) {
+	for _, config := range []PersistentCollections{
+		{Timeout: "0s"},
+		{SnapshotInterval: "soon"},
+		{MaxRecords: -1},
+	} {
+		if _, err := newCollectionSettings(&config); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
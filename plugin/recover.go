@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"runtime/debug"
+)
+
+// recoverInspection turns a panic of an inspection, e.g. in Coraza or in a rule operator, into an internal error
+// handled by the on_error policy, a panic on the Envoy worker would abort the whole process. The transaction is
+// no longer inspected afterwards, its state is unknown.
+func (f *filter) recoverInspection(status *api.StatusType) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	f.panicked = true
+	f.logPanic(r)
+	if f.destroyed.Load() {
+		return
+	}
+	if f.isInterruption {
+		// the local reply is already sent
+		*status = api.LocalReply
+		return
+	}
+	*status, _ = f.onError("Panic")
+}
+
+// recoverClose recovers a panic while closing the transaction, the transaction is closed anyway so that its
+// resources are released
+func (f *filter) recoverClose() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	f.logPanic(r)
+	f.processingError("Panic")
+	defer func() {
+		if r := recover(); r != nil {
+			f.logPanic(r)
+		}
+	}()
+	_ = f.tx.Close()
+}
+
+func (f *filter) logPanic(r interface{}) {
+	f.logStream(api.Error, f.log().str("panic", fmt.Sprint(r)).str("stack", string(debug.Stack())).msg("Recovered from a panic"))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecoverInspection(t *testing.T) {
+	tests := []struct {
+		name        string
+		closed      bool
+		interrupted bool
+		destroyed   bool
+		want        api.StatusType
+		replies     []int
+		metadata    bool
+	}{
+		// the open policy lets the stream continue, it is no longer inspected
+		{"open", false, false, false, api.Continue, nil, true},
+		{"closed", true, false, false, api.LocalReply, []int{503}, true},
+		// the local reply of the interruption is already sent
+		{"interrupted", true, true, false, api.LocalReply, nil, false},
+		// the callbacks of a destroyed stream are not used
+		{"destroyed", true, false, true, api.Running, nil, false},
+	}
+	for _, test := range tests {
+		callbacks := newTestCallbacks()
+		f := &filter{
+			callbacks: callbacks,
+			conf:      configuration{onErrorPolicies: map[string]*onErrorPolicy{"waf1": {closed: test.closed, status: defaultOnErrorStatus}}},
+			directive: "waf1",
+			tx:        newTestTransaction(t, "SecRuleEngine On"),
+		}
+		f.destroyed.Store(test.destroyed)
+		got := f.runInspection(func() api.StatusType {
+			f.isInterruption = test.interrupted
+			panic("rule operator failed")
+		})
+		if got != test.want || !f.panicked || !reflect.DeepEqual(callbacks.replies, test.replies) {
+			t.Errorf("%s: runInspection = %v, panicked %v, replies %v, want %v, %v", test.name, got, f.panicked, callbacks.replies, test.want, test.replies)
+		}
+		if _, ok := callbacks.metadata["error"]; ok != test.metadata {
+			t.Errorf("%s: error metadata %v", test.name, callbacks.metadata["error"])
+		}
+		if !test.destroyed {
+			if len(callbacks.logs) == 0 || !strings.Contains(callbacks.logs[0], `transaction_id="test"`) || !strings.Contains(callbacks.logs[0], `panic="rule operator failed"`) || !strings.Contains(callbacks.logs[0], "stack=") {
+				t.Errorf("%s: panic logged as %q", test.name, callbacks.logs)
+			}
+		}
+		// the transaction is no longer inspected, its state is unknown
+		if got := f.runInspection(func() api.StatusType {
+			t.Errorf("%s: inspection ran after a panic", test.name)
+			return api.StopAndBuffer
+		}); got != api.Continue {
+			t.Errorf("%s: runInspection = %v after a panic, want %v", test.name, got, api.Continue)
+		}
+	}
+}
+
+// testPanicTransaction panics while it is closed
+type testPanicTransaction struct {
+	testClosedTransaction
+	panicOnClose bool
+}
+
+func (tx testPanicTransaction) ProcessLogging() {
+	panic("audit log failed")
+}
+
+func (tx testPanicTransaction) Close() error {
+	if tx.panicOnClose {
+		close(tx.closed)
+		panic("close failed")
+	}
+	return tx.testClosedTransaction.Close()
+}
+
+func TestRecoverClose(t *testing.T) {
+	waf, err := coraza.NewWAF(coraza.NewWAFConfig().WithDirectives("SecRuleEngine On"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		panicOnClose bool
+	}{
+		// the transaction is closed anyway, so that its resources are released
+		{"process logging", false},
+		{"close", true},
+	}
+	for _, test := range tests {
+		tx := testPanicTransaction{testClosedTransaction{waf.NewTransaction(), make(chan struct{})}, test.panicOnClose}
+		f := &filter{callbacks: newTestCallbacks(), directive: "waf1", host: "recover.example.com", tx: tx, processResponseBody: true}
+		f.destroyed.Store(true)
+		counter := metrics.processingErrors.with("waf1", "recover.example.com", "Panic")
+		count := counter.value.Load()
+		f.closeTransaction()
+		select {
+		case <-tx.closed:
+		default:
+			t.Errorf("%s: transaction not closed", test.name)
+		}
+		if got := counter.value.Load() - count; got != 1 {
+			t.Errorf("%s: %d panics counted", test.name, got)
+		}
+	}
+}
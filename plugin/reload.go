@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultRulesDirPollInterval = 10 * time.Second
+
+// rulesWatcher polls the rules_dir directory and recompiles the directive sets including its files
+// when they change. The new directive sets are swapped atomically, the streams already created keep
+// the wafMaps they started with, and when a directive set fails to compile the last good ones stay active.
+type rulesWatcher struct {
+	dir         string
+	interval    time.Duration
+	rootFS      fs.FS
+	directives  WafDirectives
+	wafMaps     *atomic.Pointer[wafMaps]
+	fingerprint string
+	stop        chan struct{}
+}
+
+// rulesWatcherHandle is referenced by the configuration, the watcher goroutine is stopped
+// once the configuration, and therefore the handle, is garbage collected
+type rulesWatcherHandle struct {
+	watcher *rulesWatcher
+}
+
+func newRulesWatcher(dir string, interval time.Duration, rootFS fs.FS, directives WafDirectives, wafMaps *atomic.Pointer[wafMaps]) (*rulesWatcherHandle, error) {
+	fingerprint, err := rulesDirFingerprint(dir)
+	if err != nil {
+		return nil, err
+	}
+	dependents := make(WafDirectives)
+	for name, rules := range directives {
+		if usesRulesDir(rules) {
+			dependents[name] = rules
+		}
+	}
+	w := &rulesWatcher{
+		dir:         dir,
+		interval:    interval,
+		rootFS:      rootFS,
+		directives:  dependents,
+		wafMaps:     wafMaps,
+		fingerprint: fingerprint,
+		stop:        make(chan struct{}),
+	}
+	handle := &rulesWatcherHandle{watcher: w}
+	runtime.SetFinalizer(handle, func(h *rulesWatcherHandle) {
+		close(h.watcher.stop)
+	})
+	go w.run()
+	return handle, nil
+}
+
+func (w *rulesWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.poll()
+		}
+	}
+}
+
+func (w *rulesWatcher) poll() {
+	reloaded, err := w.reload()
+	if err != nil {
+		api.LogError(BuildLoggerMessage().str("rules_dir", w.dir).err(err).msg("Failed to reload rules, keep the current rules"))
+		return
+	}
+	if reloaded {
+		api.LogInfo(BuildLoggerMessage().str("rules_dir", w.dir).int("directives", len(w.directives)).msg("Rules reloaded"))
+	}
+}
+
+// reload recompiles the directive sets when the files changed, and reports whether they were swapped. The fingerprint
+// is only recorded once they are, so that a failed reload is retried on the next poll.
+func (w *rulesWatcher) reload() (bool, error) {
+	fingerprint, err := rulesDirFingerprint(w.dir)
+	if err != nil {
+		return false, err
+	}
+	if fingerprint == w.fingerprint {
+		return false, nil
+	}
+	current := *w.wafMaps.Load()
+	reloaded := make(wafMaps, len(current))
+	for name, waf := range current {
+		reloaded[name] = waf
+	}
+	for _, name := range sortedKeys(w.directives) {
+		waf, err := newWAF(w.rootFS, w.directives[name])
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("%s %s", name, err.Error()))
+		}
+		reloaded[name] = waf
+	}
+	w.wafMaps.Store(&reloaded)
+	w.fingerprint = fingerprint
+	return true, nil
+}
+
+// usesRulesDir reports whether the directive set includes files of the rules_dir directory
+func usesRulesDir(rules Directives) bool {
+	for _, directive := range rules.SimpleDirectives {
+		if strings.Contains(directive, rulesDirAlias) {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesDirFingerprint summarizes the names, sizes and modification times of the files of the directory
+func rulesDirFingerprint(dir string) (string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", errors.New(fmt.Sprintf("rules_dir %s is not a directory", dir))
+	}
+	var b strings.Builder
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		b.WriteString(path)
+		b.WriteByte('|')
+		b.WriteString(strconv.FormatInt(info.Size(), 10))
+		b.WriteByte('|')
+		b.WriteString(strconv.FormatInt(info.ModTime().UnixNano(), 10))
+		b.WriteByte('\n')
+		return nil
+	})
+	return b.String(), err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRulesWatcherReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rules.conf")
+	writeRules := func(rules string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// the fingerprint changes whatever the resolution of the file system times
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	writeRules(`SecRule ARGS "@contains first" "id:1,phase:1,deny"`, start)
+	rootFS := withRulesDir(dir)
+	directives := WafDirectives{"waf1": {SimpleDirectives: []string{"SecRuleEngine On", "Include @rules_dir/*.conf"}}}
+	waf, err := newWAF(rootFS, directives["waf1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	maps := &atomic.Pointer[wafMaps]{}
+	maps.Store(&wafMaps{"waf1": waf})
+	fingerprint, err := rulesDirFingerprint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &rulesWatcher{dir: dir, rootFS: rootFS, directives: directives, wafMaps: maps, fingerprint: fingerprint}
+	blocks := func(arg string) bool {
+		tx := (*maps.Load())["waf1"].NewTransaction()
+		defer tx.Close()
+		tx.ProcessURI("/?q="+arg, "GET", "HTTP/1.1")
+		return tx.ProcessRequestHeaders() != nil
+	}
+
+	tests := []struct {
+		name     string
+		rules    string
+		reloaded bool
+		ok       bool
+		blocked  string
+		allowed  string
+	}{
+		{"unchanged", "", false, true, "first", "second"},
+		{"good reload", `SecRule ARGS "@contains second" "id:1,phase:1,deny"`, true, true, "second", "first"},
+		// the last good rules stay active
+		{"failed reload", `SecRule ARGS "@contains third" "id:1,phase:1,deny`, false, false, "second", "third"},
+		// the failed reload is retried, and fails again as long as the files are not fixed
+		{"failed retry", "", false, false, "second", "third"},
+		{"fixed retry", `SecRule ARGS "@contains third" "id:1,phase:1,deny"`, true, true, "third", "second"},
+		{"unchanged after retry", "", false, true, "third", "second"},
+	}
+	for i, test := range tests {
+		if len(test.rules) != 0 {
+			writeRules(test.rules, start.Add(time.Duration(i)*time.Minute))
+		}
+		before := maps.Load()
+		reloaded, err := w.reload()
+		if reloaded != test.reloaded || (err == nil) != test.ok {
+			t.Fatalf("%s: reload = %v, %v, want %v", test.name, reloaded, err, test.reloaded)
+		}
+		if swapped := maps.Load() != before; swapped != test.reloaded {
+			t.Errorf("%s: wafMaps swapped = %v", test.name, swapped)
+		}
+		if !blocks(test.blocked) || blocks(test.allowed) {
+			t.Errorf("%s: the active rules do not block %s only", test.name, test.blocked)
+		}
+	}
+}
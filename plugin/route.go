@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type RouteDirectiveMap []RouteDirective
+
+// RouteDirective selects a directive set for the requests matching all of its non-empty conditions
+type RouteDirective struct {
+	Host       string   `json:"host"`
+	PathPrefix string   `json:"path_prefix"`
+	PathRegex  string   `json:"path_regex"`
+	Methods    []string `json:"methods"`
+	Directive  string   `json:"directive"`
+}
+
+// routeMatcher evaluates the route_directive_map rules in order, the first matching rule wins
+type routeMatcher struct {
+	routes []routeRule
+}
+
+type routeRule struct {
+	host       *hostMatcher
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    map[string]struct{}
+	directive  string
+}
+
+func newRouteMatcher(routeDirectiveMap RouteDirectiveMap) (*routeMatcher, error) {
+	m := &routeMatcher{routes: make([]routeRule, 0, len(routeDirectiveMap))}
+	for i, route := range routeDirectiveMap {
+		rule := routeRule{
+			pathPrefix: route.PathPrefix,
+			directive:  route.Directive,
+		}
+		if len(route.Host) != 0 {
+			host, err := newHostMatcher(HostDirectiveMap{route.Host: route.Directive})
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("route_directive_map[%d]: %s", i, err.Error()))
+			}
+			rule.host = host
+		}
+		if len(route.PathRegex) != 0 {
+			re, err := regexp.Compile(route.PathRegex)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("route_directive_map[%d]: path_regex is not a valid regexp: %s", i, err.Error()))
+			}
+			rule.pathRegex = re
+		}
+		if len(route.Methods) != 0 {
+			rule.methods = make(map[string]struct{}, len(route.Methods))
+			for _, method := range route.Methods {
+				rule.methods[strings.ToUpper(method)] = struct{}{}
+			}
+		}
+		m.routes = append(m.routes, rule)
+	}
+	return m, nil
+}
+
+// match returns the directive of the first rule matching the request, the path may carry a query string.
+// The path is normalized and the prefixes are matched case-insensitively, so that /admin is neither bypassed
+// by //admin, /./admin, /%61dmin nor /Admin.
+func (m *routeMatcher) match(host, path, method string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	path = normalizePath(path)
+	for _, rule := range m.routes {
+		if rule.host != nil {
+			if _, ok := rule.host.match(host); !ok {
+				continue
+			}
+		}
+		if len(path) < len(rule.pathPrefix) || !strings.EqualFold(path[:len(rule.pathPrefix)], rule.pathPrefix) {
+			continue
+		}
+		if rule.pathRegex != nil && !rule.pathRegex.MatchString(path) {
+			continue
+		}
+		if rule.methods != nil {
+			if _, ok := rule.methods[method]; !ok {
+				continue
+			}
+		}
+		return rule.directive, true
+	}
+	return "", false
+}
+
+// normalizePath removes the query string, decodes the percent-encoded unreserved characters, merges the slashes
+// and resolves the dot segments of the path. A trailing slash is kept.
+func normalizePath(p string) string {
+	if i := strings.IndexByte(p, '?'); i != -1 {
+		p = p[:i]
+	}
+	if strings.IndexByte(p, '%') != -1 {
+		var b strings.Builder
+		for i := 0; i < len(p); i++ {
+			if p[i] == '%' && i+2 < len(p) {
+				if c, err := strconv.ParseUint(p[i+1:i+3], 16, 8); err == nil && isUnreserved(byte(c)) {
+					b.WriteByte(byte(c))
+					i += 2
+					continue
+				}
+			}
+			b.WriteByte(p[i])
+		}
+		p = b.String()
+	}
+	trailingSlash := strings.HasSuffix(p, "/")
+	p = path.Clean("/" + p)
+	if trailingSlash && p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// isUnreserved reports whether the character is unreserved in a URI, its percent-encoding is equivalent to it
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~'
+}
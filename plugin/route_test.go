@@ -0,0 +1,83 @@
+package main
+
+import "testing"
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"", "/"},
+		{"/admin", "/admin"},
+		{"/admin/?a=b", "/admin/"},
+		{"//admin//x", "/admin/x"},
+		{"/./admin/x", "/admin/x"},
+		{"/foo/../admin/x", "/admin/x"},
+		{"/../../admin", "/admin"},
+		{"/%61dmin/x", "/admin/x"},
+		{"/%2e/admin", "/admin"},
+		{"/%2E%2E/admin", "/admin"},
+		// reserved characters stay encoded
+		{"/a%2Fb", "/a%2Fb"},
+		{"/a%3fb?c", "/a%3fb"},
+		// malformed escapes are left as they are
+		{"/a%zz", "/a%zz"},
+		{"/a%6", "/a%6"},
+	}
+	for _, test := range tests {
+		if got := normalizePath(test.path); got != test.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestRouteMatcher(t *testing.T) {
+	m, err := newRouteMatcher(RouteDirectiveMap{
+		{PathPrefix: "/admin", Directive: "admin"},
+		{Host: "api.example.com", PathPrefix: "/shop/", Directive: "shop"},
+		{Host: "api.example.com", PathRegex: "^/blog/[0-9]+$", Methods: []string{"post", "PUT"}, Directive: "blog"},
+		{Host: "*.example.com", Directive: "wildcard"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, path, method string
+		want               string
+		ok                 bool
+	}{
+		{"foo.com", "/admin/x", "GET", "admin", true},
+		{"foo.com", "//admin/x", "GET", "admin", true},
+		{"foo.com", "/%61dmin/x", "GET", "admin", true},
+		{"foo.com", "/./admin/x", "GET", "admin", true},
+		{"foo.com", "/Admin/x", "GET", "admin", true},
+		{"foo.com", "/public/../admin", "GET", "admin", true},
+		{"foo.com", "/public", "GET", "", false},
+		{"api.example.com", "/shop/cart?id=1", "GET", "shop", true},
+		{"api.example.com", "/shop", "GET", "wildcard", true},
+		{"api.example.com", "/blog/42", "POST", "blog", true},
+		{"api.example.com", "/blog/42", "GET", "wildcard", true},
+		{"api.example.com", "/blog/42/x", "PUT", "wildcard", true},
+		{"api.example.com:8080", "/shop/", "GET", "shop", true},
+		// the first matching rule wins
+		{"api.example.com", "/admin", "GET", "admin", true},
+		{"example.com", "/shop/", "GET", "", false},
+	}
+	for _, test := range tests {
+		got, ok := m.match(test.host, test.path, test.method)
+		if got != test.want || ok != test.ok {
+			t.Errorf("match(%q, %q, %q) = %q, %v, want %q, %v", test.host, test.path, test.method, got, ok, test.want, test.ok)
+		}
+	}
+	var nilMatcher *routeMatcher
+	if _, ok := nilMatcher.match("foo.com", "/", "GET"); ok {
+		t.Error("nil matcher matched")
+	}
+}
+
+func TestRouteMatcherInvalidRegexp(t *testing.T) {
+	if _, err := newRouteMatcher(RouteDirectiveMap{{PathRegex: "(", Directive: "waf"}}); err == nil {
+		t.Error("invalid path_regex accepted")
+	}
+}
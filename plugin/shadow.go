@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/corazawaf/coraza/v3"
+	"github.com/corazawaf/coraza/v3/types"
+	"github.com/envoyproxy/envoy/contrib/golang/common/go/api"
+	"strconv"
+)
+
+// shadow runs a second transaction on the shadow directive set through every phase of the stream.
+// Its interruptions are never enforced, they are only compared with the ones of the enforcing
+// transaction once the stream is done, so that a new directive set can be evaluated on real traffic.
+type shadow struct {
+	logStream             func(level api.LogType, msg string)
+	log                   func() messageTemplate
+	directive             string
+	tx                    types.Transaction
+	requestBodyProcessed  bool
+	responseBodyProcessed bool
+}
+
+// newShadow creates the shadow transaction, it shares the id of the enforcing transaction so that their logs can be joined
+func newShadow(logStream func(level api.LogType, msg string), log func() messageTemplate, directive string, waf coraza.WAF, id string) *shadow {
+	return &shadow{
+		logStream: logStream,
+		log:       log,
+		directive: directive,
+		tx:        waf.NewTransactionWithID(id),
+	}
+}
+
+func (s *shadow) processRequestHeaders(headerMap api.RequestHeaderMap, host, server, srcIP string, srcPort int, destIP string, destPort int, protocol string) {
+	if s == nil {
+		return
+	}
+	tx := s.tx
+	if len(host) != 0 {
+		tx.AddRequestHeader("Host", host)
+	}
+	tx.SetServerName(server)
+	tx.ProcessConnection(srcIP, srcPort, destIP, destPort)
+	tx.ProcessURI(headerMap.Path(), headerMap.Method(), protocol)
+	headerMap.Range(func(key, value string) bool {
+		tx.AddRequestHeader(key, value)
+		return true
+	})
+	tx.ProcessRequestHeaders()
+}
+
+func (s *shadow) writeRequestBody(body []byte, endStream bool) {
+	if s == nil || s.requestBodyProcessed || s.tx.IsInterrupted() {
+		return
+	}
+	if len(body) > 0 && s.tx.IsRequestBodyAccessible() {
+		if _, _, err := s.tx.WriteRequestBody(body); err != nil {
+			s.logStream(api.Debug, s.log().str("shadow_directive", s.directive).err(err).msg("Shadow failed to write request body"))
+			return
+		}
+	}
+	if endStream {
+		s.processRequestBody()
+	}
+}
+
+func (s *shadow) processRequestBody() {
+	if s == nil || s.requestBodyProcessed {
+		return
+	}
+	s.requestBodyProcessed = true
+	if _, err := s.tx.ProcessRequestBody(); err != nil {
+		s.logStream(api.Debug, s.log().str("shadow_directive", s.directive).err(err).msg("Shadow failed to process request body"))
+	}
+}
+
+func (s *shadow) processResponseHeaders(headerMap api.ResponseHeaderMap, code int, protocol string) {
+	if s == nil {
+		return
+	}
+	s.processRequestBody()
+	headerMap.Range(func(key, value string) bool {
+		s.tx.AddResponseHeader(key, value)
+		return true
+	})
+	s.tx.ProcessResponseHeaders(code, protocol)
+}
+
+func (s *shadow) writeResponseBody(body []byte, endStream bool) {
+	if s == nil || s.responseBodyProcessed || s.tx.IsInterrupted() {
+		return
+	}
+	if len(body) > 0 && s.tx.IsResponseBodyAccessible() {
+		if _, _, err := s.tx.WriteResponseBody(body); err != nil {
+			s.logStream(api.Debug, s.log().str("shadow_directive", s.directive).err(err).msg("Shadow failed to write response body"))
+			return
+		}
+	}
+	if endStream {
+		s.processResponseBody()
+	}
+}
+
+func (s *shadow) processResponseBody() {
+	if s == nil || s.responseBodyProcessed {
+		return
+	}
+	s.responseBodyProcessed = true
+	if _, err := s.tx.ProcessResponseBody(); err != nil {
+		s.logStream(api.Debug, s.log().str("shadow_directive", s.directive).err(err).msg("Shadow failed to process response body"))
+	}
+}
+
+// close compares the verdicts of the shadow and the enforcing transactions, logs and counts the disagreement, and closes
+// the shadow transaction
+func (s *shadow) close(tx types.Transaction, directive string) {
+	if s == nil {
+		return
+	}
+	s.processResponseBody()
+	interruption, shadowInterruption := tx.Interruption(), s.tx.Interruption()
+	if (interruption == nil) != (shadowInterruption == nil) || ruleID(interruption) != ruleID(shadowInterruption) {
+		metrics.shadowDisagreements.inc(directive, s.directive)
+		s.logStream(api.Info, s.log().
+			int("rule", ruleID(interruption)).
+			str("phase", interruptionPhase(tx)).
+			str("shadow_directive", s.directive).
+			int("shadow_rule", ruleID(shadowInterruption)).
+			str("shadow_phase", interruptionPhase(s.tx)).
+			msg("Shadow directive disagrees with the enforcing one"))
+	}
+	s.tx.ProcessLogging()
+	_ = s.tx.Close()
+}
+
+// ruleID returns the id of the rule which caused the interruption, 0 when there is no interruption
+func ruleID(interruption *types.Interruption) int {
+	if interruption == nil {
+		return 0
+	}
+	return interruption.RuleID
+}
+
+// interruptionPhase returns the phase of the rule which interrupted the transaction, empty when it is not interrupted
+func interruptionPhase(tx types.Transaction) string {
+	interruption := tx.Interruption()
+	if interruption == nil {
+		return ""
+	}
+	for _, matched := range tx.MatchedRules() {
+		if matched.Rule().ID() == interruption.RuleID {
+			return strconv.Itoa(int(matched.Rule().Phase()))
+		}
+	}
+	return ""
+}